@@ -0,0 +1,151 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+import emvjson "emv/json"
+
+// remoteContexts returns the number of contexts held by the sessions of
+// hdlr.
+func remoteContexts(hdlr *ScardHandler) (n int) {
+	hdlr.lock.Lock()
+	defer hdlr.lock.Unlock()
+	for _, sc := range hdlr.cookies {
+		n += len(sc.session.Contexts())
+	}
+	return
+}
+
+func TestRemoteBackend(t *testing.T) {
+	hdlrA, hdlrB := &ScardHandler{Insecure: true}, &ScardHandler{Insecure: true}
+	a, b := httptest.NewServer(hdlrA), httptest.NewServer(hdlrB)
+	defer a.Close()
+	defer b.Close()
+
+	remote := emvjson.NewRemoteBackend(map[string]string{"a": a.URL + SCARD_PATH, "b": b.URL + SCARD_PATH})
+	if version := remote.Version(); version != "a:virtual b:virtual" {
+		t.Errorf("unexpected version: %s", version)
+	}
+
+	ctx, err := remote.EstablishContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers, err := ctx.ListReaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(readers, "a:"+virtualReader.Name) || !contains(readers, "b:"+virtualReader.Name) {
+		t.Fatalf("missing readers: %v", readers)
+	}
+
+	if _, err = ctx.Connect("c:"+virtualReader.Name, scard.SHARE_SHARED, scard.PROTOCOL_ANY); err != scard.E_UNKNOWN_READER {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	card, err := ctx.Connect("b:"+virtualReader.Name, scard.SHARE_SHARED, scard.PROTOCOL_ANY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := card.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Reader != "b:"+virtualReader.Name || !bytes.Equal(status.ATR, []byte{0x3B, 0x00}) {
+		t.Errorf("unexpected status: %v", status)
+	}
+	resp, err := card.Transmit([]byte{0x00, 0xA4, 0x00, 0x00, 0x02, 0x3F, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, []byte{0x90, 0x00}) {
+		t.Errorf("unexpected response: %x", resp)
+	}
+	if err = card.Disconnect(scard.LEAVE_CARD); err != nil {
+		t.Error(err)
+	}
+	if _, err = card.Transmit([]byte{0x00, 0xA4, 0x00, 0x00, 0x02, 0x3F, 0x00}); err == nil {
+		t.Error("transmit on disconnected card succeeded")
+	}
+
+	states := []scard.ReaderState{
+		{Reader: "a:" + virtualReader.Name, CurrentState: scard.STATE_UNAWARE},
+		{Reader: "c:unknown", CurrentState: scard.STATE_UNAWARE},
+	}
+	if err = ctx.GetStatusChange(states, -1); err != nil {
+		t.Fatal(err)
+	}
+	if states[0].EventState&scard.STATE_PRESENT == 0 {
+		t.Errorf("card not present: %x", states[0].EventState)
+	}
+	if states[1].EventState&scard.STATE_UNKNOWN == 0 {
+		t.Errorf("unknown reader not reported: %x", states[1].EventState)
+	}
+
+	if err = ctx.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := ctx.IsValid(); valid {
+		t.Error("released context still valid")
+	}
+	if n := remoteContexts(hdlrA) + remoteContexts(hdlrB); n != 0 {
+		t.Errorf("remote contexts not released: %d", n)
+	}
+}
+
+func TestRemoteBackendUnreachable(t *testing.T) {
+	a, b := httptest.NewServer(&ScardHandler{Insecure: true}), httptest.NewServer(&ScardHandler{Insecure: true})
+	defer a.Close()
+	remote := emvjson.NewRemoteBackend(map[string]string{"a": a.URL + SCARD_PATH, "b": b.URL + SCARD_PATH})
+	front := &ScardHandler{Backend: remote}
+
+	ctx := emvjson.ScardContextResponse{}
+	cookie := sessionCookie(post(t, front, nil, `{"method":"establishContext"}`, &ctx))
+	if ctx.Error != nil {
+		t.Fatalf("establishContext: %s", ctx.Error)
+	}
+	defer post(t, front, cookie, fmt.Sprintf(`{"method":"releaseContext", "ctx":"%s"}`, ctx.Ctx), nil)
+
+	// b going away leaves a usable.
+	b.Close()
+	readers := emvjson.ScardListReadersResponse{}
+	w := post(t, front, cookie, fmt.Sprintf(`{"method":"listReaders", "ctx":"%s"}`, ctx.Ctx), &readers)
+	if w.Code != http.StatusOK || readers.Error != nil || !contains(readers.Readers, "a:"+virtualReader.Name) || contains(readers.Readers, "b:"+virtualReader.Name) {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRemoteBackendWaitWithoutRemote(t *testing.T) {
+	a := httptest.NewServer(&ScardHandler{Insecure: true})
+	defer a.Close()
+	remote := emvjson.NewRemoteBackend(map[string]string{"a": a.URL + SCARD_PATH})
+	ctx, err := remote.EstablishContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Release()
+
+	states := []scard.ReaderState{{Reader: emvjson.PNP_NOTIFICATION, CurrentState: scard.STATE_UNKNOWN}}
+	start := time.Now()
+	if err = ctx.GetStatusChange(states, 100*time.Millisecond); err != scard.E_TIMEOUT {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("returned without waiting")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ctx.Cancel()
+	}()
+	if err = ctx.GetStatusChange(states, -1); err != scard.E_CANCELLED {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
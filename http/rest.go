@@ -0,0 +1,93 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+import emvjson "emv/json"
+
+// queryValue returns the query parameter key or def if it isn't set.
+func queryValue(query url.Values, key string, def string) string {
+	if value := query.Get(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// restStatus is statusCode for REST requests, the resources they address
+// may not exist.
+func restStatus(e *emvjson.ScardError) int {
+	if e.HasCode(scard.E_INVALID_HANDLE) || e.HasCode(scard.E_UNKNOWN_READER) ||
+		(e != nil && e.Category == emvjson.CATEGORY_EXPIRED) {
+		return http.StatusNotFound
+	}
+	return statusCode(e)
+}
+
+// serveRest maps the REST URLs below SCARD_PATH onto the JSON methods,
+// see ScardHandler.
+func (hdlr *ScardHandler) serveRest(w http.ResponseWriter, req *http.Request) {
+	segments := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), SCARD_PATH), "/")
+	for i := range segments {
+		var err error
+		// reader names may contain (escaped) slashes.
+		if segments[i], err = url.PathUnescape(segments[i]); err != nil {
+			http.NotFound(w, req)
+			return
+		}
+	}
+
+	var name string
+	var allow []string
+	var body io.Reader
+	query := req.URL.Query()
+	fields := make(map[string]interface{})
+	switch {
+	case len(segments) == 1 && segments[0] == "readers":
+		name, allow = "listReaders", []string{"GET"}
+	case len(segments) == 3 && segments[0] == "readers" && segments[2] == "connect":
+		name, allow = "connect", []string{"POST"}
+		fields["reader"] = segments[1]
+		fields["shareMode"] = queryValue(query, "shareMode", string(emvjson.SHARE_SHARED))
+		fields["protocol"] = queryValue(query, "protocol", string(emvjson.PROTOCOL_ANY))
+	case len(segments) == 2 && segments[0] == "cards":
+		name, allow = "status", []string{"GET", "DELETE"}
+		fields["card"] = segments[1]
+		if req.Method == "DELETE" {
+			name = "disconnect"
+			fields["disposition"] = queryValue(query, "disposition", string(emvjson.LEAVE_CARD))
+		}
+	case len(segments) == 3 && segments[0] == "cards" && segments[2] == "transmit":
+		name, allow = "transmit", []string{"POST"}
+		fields["card"] = segments[1]
+		body = req.Body
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	allowed := false
+	for _, method := range allow {
+		allowed = allowed || method == req.Method
+	}
+	if !allowed {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := hdlr.run(w, req, func(session *emvjson.Session) interface{} {
+		return session.Call(name, body, fields)
+	})
+	e := emvjson.ResponseError(resp)
+	if card, ok := resp.(*emvjson.ScardConnectResponse); ok && e == nil {
+		w.Header().Set("Location", SCARD_PATH+"cards/"+url.PathEscape(string(card.Card)))
+		writeJson(w, http.StatusCreated, resp)
+		return
+	}
+	writeJson(w, restStatus(e), resp)
+}
@@ -0,0 +1,106 @@
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+import emvjson "emv/json"
+
+// rest sends a REST request with the session cookie, if any.
+func rest(t *testing.T, hdlr http.Handler, cookie *http.Cookie, method, path, body string, resp interface{}) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, r)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	hdlr.ServeHTTP(w, req)
+	if resp != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("%s %s: %s: %s", method, path, err, w.Body)
+		}
+	}
+	return w
+}
+
+func TestScardHandlerRest(t *testing.T) {
+	hdlr := &ScardHandler{}
+
+	readers := emvjson.ScardListReadersResponse{}
+	w := rest(t, hdlr, nil, "GET", SCARD_PATH+"readers", "", &readers)
+	cookie := sessionCookie(w)
+	if w.Code != http.StatusOK || !contains(readers.Readers, virtualReader.Name) || cookie == nil {
+		t.Fatalf("GET readers: %d %s", w.Code, w.Body)
+	}
+
+	card := emvjson.ScardConnectResponse{}
+	connect := SCARD_PATH + "readers/" + url.PathEscape(virtualReader.Name) + "/connect?shareMode=EXCLUSIVE"
+	if w = rest(t, hdlr, cookie, "POST", connect, "", &card); w.Code != http.StatusCreated || card.Card == "" {
+		t.Fatalf("connect: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if location != SCARD_PATH+"cards/"+string(card.Card) {
+		t.Errorf("unexpected location: %s", location)
+	}
+
+	status := emvjson.ScardStatusResponse{}
+	if w = rest(t, hdlr, cookie, "GET", location, "", &status); w.Code != http.StatusOK || status.Reader != virtualReader.Name {
+		t.Errorf("status: %d %s", w.Code, w.Body)
+	}
+
+	transmit := emvjson.ScardTransmitResponse{}
+	if w = rest(t, hdlr, cookie, "POST", location+"/transmit", `{"data":"00A40000023F00"}`, &transmit); w.Code != http.StatusOK || transmit.Data != "9000" {
+		t.Errorf("transmit: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		cookie *http.Cookie
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{cookie, "POST", connect, "", http.StatusConflict},
+		{cookie, "POST", SCARD_PATH + "readers/Unknown%20Reader/connect", "", http.StatusNotFound},
+		{cookie, "POST", SCARD_PATH + "readers", "", http.StatusMethodNotAllowed},
+		{cookie, "PUT", location, "", http.StatusMethodNotAllowed},
+		{cookie, "GET", SCARD_PATH + "cards/card_unknown", "", http.StatusNotFound},
+		{cookie, "GET", SCARD_PATH + "nonsense", "", http.StatusNotFound},
+		{cookie, "POST", location + "/transmit", "", http.StatusBadRequest},
+		{cookie, "POST", location + "/transmit", `{"data":"00A4", "unknown":1}`, http.StatusBadRequest},
+		// cards are scoped to the session.
+		{nil, "GET", location, "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w = rest(t, hdlr, test.cookie, test.method, test.path, test.body, nil); w.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", test.method, test.path, test.status, w.Code, w.Body)
+		}
+	}
+
+	if w = rest(t, hdlr, cookie, "DELETE", location+"?disposition=RESET_CARD", "", nil); w.Code != http.StatusOK {
+		t.Errorf("disconnect: %d %s", w.Code, w.Body)
+	}
+	if w = rest(t, hdlr, cookie, "GET", location, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("disconnected card: %d %s", w.Code, w.Body)
+	}
+
+	rest(t, hdlr, cookie, "DELETE", SCARD_PATH, "", nil)
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -1,42 +1,288 @@
 package http
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
 	"strings"
-	"io"
+	"sync"
+	"time"
 )
 
-import "github.com/ebfe/go.pcsclite/scard"
+import emvjson "emv/json"
+
+const (
+	SCARD_PATH     = "/scard/"
+	CONTENT_TYPE   = "application/json; charset=utf-8"
+	SESSION_COOKIE = "SCARD_SESSION"
+	WEBSOCKET_PATH = SCARD_PATH + "ws"
+	EVENTS_PATH    = SCARD_PATH + "events"
+)
+
+// SessionTimeout is the lifetime of a session cookie, every request
+// using the session renews it. The session's contexts are released once
+// it expires.
+var SessionTimeout = 30 * time.Minute
+
+// SessionCheckInterval is how often expired sessions are looked for.
+var SessionCheckInterval = time.Minute
+
+// ReapInterval is how often the reaper looks for idle contexts and cards,
+// see emvjson.StartReaper. It's started with the first ScardHandler
+// serving requests.
+var ReapInterval = time.Minute
+
+var reaper sync.Once
 
 type ScardCookie struct {
-	cookie *http.Cookie
-	ctx    *scard.Context
+	cookie  *http.Cookie
+	session *emvjson.Session
 }
 
+// ScardHandler serves the JSON API of package emv/json: requests are
+// POSTed to SCARD_PATH, the status code reflects the error of flat
+// requests:
+//
+//	400 Bad Request               malformed request (PARSE_ERROR)
+//	404 Not Found                 unknown method
+//	409 Conflict                  sharing violation
+//	413 Request Entity Too Large  request exceeds emvjson.MaxRequestSize
+//	500 Internal Server Error
+//	503 Service Unavailable       PC/SC service not running
+//
+// other PC/SC errors (e.g. a removed card) are part of a successful
+// exchange and answered with 200. JSON-RPC requests and batches carry
+// their errors in the body and are always answered with 200.
+//
+// Each client gets its own emvjson.Session: establishContext issues a
+// secure, HttpOnly session cookie (see Insecure) and the tokens
+// established can only be used by requests carrying the cookie. The
+// session's contexts are released when the cookie expires (see
+// SessionTimeout) or is revoked by a DELETE to SCARD_PATH.
+//
+// The same operations are available at REST URLs below SCARD_PATH:
+//
+//	GET    /scard/readers                 listReaders
+//	POST   /scard/readers/{name}/connect  connect (?shareMode=&protocol=)
+//	GET    /scard/cards/{token}           status
+//	POST   /scard/cards/{token}/transmit  transmit ({"data":".."})
+//	DELETE /scard/cards/{token}           disconnect (?disposition=)
+//
+// They run with the session's default context (emvjson.Session.Context)
+// and answer unknown readers and cards with 404.
+//
+// WEBSOCKET_PATH accepts WebSocket connections speaking the JSON API,
+// with server-pushed reader and card events, see serveWebSocket. Clients
+// only interested in the events GET them as Server-Sent Events from
+// EVENTS_PATH.
 type ScardHandler struct {
+	// Backend is used by the handler's sessions, nil for the default
+	// backend (see emvjson.SetBackend). Events always come from the
+	// default backend.
+	Backend emvjson.Backend
+	// Insecure lets the session cookie be sent over plain HTTP, e.g. to
+	// serve an emvjson.RemoteBackend. Clients drop secure cookies
+	// received without TLS.
+	Insecure bool
+
+	lock    sync.Mutex
+	once    sync.Once
 	cookies map[string]*ScardCookie
 }
 
-func (hdlr *ScardHandler) establishContext(w http.ResponseWriter, req *http.Request) {
-	// check cookie set
-	// set cookie
-	// establish context (have some sort of timeout function synced to cookie timeout)
-	// put cookie in map
+// start initializes the handler and starts looking for expired sessions
+// and idle handles.
+func (hdlr *ScardHandler) start() {
+	reaper.Do(func() {
+		emvjson.StartReaper(ReapInterval)
+	})
+	hdlr.once.Do(func() {
+		hdlr.lock.Lock()
+		if hdlr.cookies == nil {
+			hdlr.cookies = make(map[string]*ScardCookie)
+		}
+		hdlr.lock.Unlock()
+		go func() {
+			for now := range time.Tick(SessionCheckInterval) {
+				hdlr.expire(now)
+			}
+		}()
+	})
 }
 
-//isvalid
-//listReaders
-//cancel
+// lookup returns the unexpired session the request's cookie refers to,
+// or nil.
+func (hdlr *ScardHandler) lookup(req *http.Request) *ScardCookie {
+	cookie, err := req.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil
+	}
+	hdlr.lock.Lock()
+	defer hdlr.lock.Unlock()
+	if sc := hdlr.cookies[cookie.Value]; sc != nil && time.Now().Before(sc.cookie.Expires) {
+		return sc
+	}
+	return nil
+}
 
-func (hdlr *ScardHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	path := req.URL.Path
-	api_func := path[strings.LastIndex(path, "/") : ]
-	switch api_func {
-		case "EstablishContext":
-			hdlr.establishContext(w,req)
-		default:
-			w.Write([]byte(api_func))
-			io.Copy(w, req.Body)
+// establish registers a new session cookie for session.
+func (hdlr *ScardHandler) establish(session *emvjson.Session) (sc *ScardCookie, err error) {
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	sc = &ScardCookie{
+		cookie: &http.Cookie{
+			Name:     SESSION_COOKIE,
+			Value:    hex.EncodeToString(id),
+			Path:     SCARD_PATH,
+			Secure:   !hdlr.Insecure,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		},
+		session: session,
+	}
+	hdlr.lock.Lock()
+	defer hdlr.lock.Unlock()
+	hdlr.cookies[sc.cookie.Value] = sc
+	return
+}
+
+// renew extends the cookie's lifetime and returns a copy to send.
+func (hdlr *ScardHandler) renew(sc *ScardCookie) *http.Cookie {
+	hdlr.lock.Lock()
+	defer hdlr.lock.Unlock()
+	sc.cookie.Expires = time.Now().Add(SessionTimeout)
+	sc.cookie.MaxAge = int(SessionTimeout / time.Second)
+	cookie := *sc.cookie
+	return &cookie
+}
+
+// revoke ends the session of the request's cookie and tells the client
+// to drop the cookie.
+func (hdlr *ScardHandler) revoke(w http.ResponseWriter, req *http.Request) {
+	if sc := hdlr.lookup(req); sc != nil {
+		hdlr.lock.Lock()
+		delete(hdlr.cookies, sc.cookie.Value)
+		cookie := *sc.cookie
+		hdlr.lock.Unlock()
+
+		sc.session.Close()
+		cookie.Expires = time.Unix(0, 0)
+		cookie.MaxAge = -1
+		http.SetCookie(w, &cookie)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expire releases the sessions whose cookie expired before now.
+func (hdlr *ScardHandler) expire(now time.Time) {
+	expired := []*ScardCookie{}
+	hdlr.lock.Lock()
+	for id, sc := range hdlr.cookies {
+		if !now.Before(sc.cookie.Expires) {
+			delete(hdlr.cookies, id)
+			expired = append(expired, sc)
+		}
 	}
+	hdlr.lock.Unlock()
+
+	for _, sc := range expired {
+		sc.session.Close()
+	}
+}
+
+// statusCode returns the HTTP status for the error of a flat request.
+func statusCode(e *emvjson.ScardError) int {
+	if e == nil {
+		return http.StatusOK
+	} else if e == emvjson.ErrTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	switch e.Category {
+	case emvjson.CATEGORY_PARSE_ERROR:
+		return http.StatusBadRequest
+	case emvjson.CATEGORY_UNKNOWN_METHOD:
+		return http.StatusNotFound
+	case emvjson.CATEGORY_SHARING_VIOLATION:
+		return http.StatusConflict
+	case emvjson.CATEGORY_SERVICE_ERROR:
+		return http.StatusServiceUnavailable
+	case emvjson.CATEGORY_INTERNAL_ERROR:
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
 }
 
+// writeJson sends resp with the given status.
+func writeJson(w http.ResponseWriter, status int, resp interface{}) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.Encode(resp)
+}
+
+// run runs f in the request's session, requests without session run in a
+// new one, which is kept (and the cookie issued) if they established a
+// context.
+func (hdlr *ScardHandler) run(w http.ResponseWriter, req *http.Request, f func(*emvjson.Session) interface{}) interface{} {
+	sc := hdlr.lookup(req)
+	session := emvjson.NewSessionWithBackend(hdlr.Backend)
+	if sc != nil {
+		session = sc.session
+	}
+	resp := f(session)
+	if sc == nil && len(session.Contexts()) != 0 {
+		var err error
+		if sc, err = hdlr.establish(session); err != nil {
+			session.Close()
+			return &emvjson.ScardResponse{Error: emvjson.ToScardError(err)}
+		}
+	}
+	if sc != nil {
+		http.SetCookie(w, hdlr.renew(sc))
+	}
+	return resp
+}
+
+func (hdlr *ScardHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, SCARD_PATH) {
+		http.NotFound(w, req)
+		return
+	}
+	hdlr.start()
+	switch req.URL.Path {
+	case SCARD_PATH:
+	case WEBSOCKET_PATH:
+		hdlr.serveWebSocket(w, req)
+		return
+	case EVENTS_PATH:
+		hdlr.serveEvents(w, req)
+		return
+	default:
+		hdlr.serveRest(w, req)
+		return
+	}
+
+	switch req.Method {
+	case "POST":
+	case "DELETE":
+		hdlr.revoke(w, req)
+		return
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := hdlr.run(w, req, func(session *emvjson.Session) interface{} {
+		return session.ScardJsonResponse(req.Body)
+	})
+	if resp == nil {
+		// only JSON-RPC notifications.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJson(w, statusCode(emvjson.ResponseError(resp)), resp)
+}
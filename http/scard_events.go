@@ -0,0 +1,66 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+import emvjson "emv/json"
+
+// EventBuffer is the number of events queued for each WebSocket or event
+// stream, further events are dropped until the client catches up.
+var EventBuffer = 64
+
+// EventStreamKeepAlive is how often a comment is sent on idle event
+// streams, keeping proxies from closing them.
+var EventStreamKeepAlive = 30 * time.Second
+
+// serveEvents streams reader and card events (see emvjson.Subscribe) at
+// EVENTS_PATH as Server-Sent Events, each one as JSON in the data field:
+//
+//	data: {"event":"CARD_PRESENT","reader":"..","atr":".."}
+//
+// All streams share the server's monitor, clients need neither a session
+// nor a context.
+func (hdlr *ScardHandler) serveEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := make(chan emvjson.Event, EventBuffer)
+	unsubscribe := emvjson.Subscribe(events)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-events:
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
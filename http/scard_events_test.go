@@ -0,0 +1,80 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import emvjson "emv/json"
+
+func TestScardEvents(t *testing.T) {
+	server := httptest.NewServer(&ScardHandler{})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + EVENTS_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response: %s %v", resp.Status, resp.Header)
+	}
+
+	events := make(chan emvjson.Event)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			e := emvjson.Event{}
+			if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(line[6:]), &e); err != nil {
+					t.Error(err)
+				}
+				events <- e
+			}
+		}
+	}()
+	next := func(reader string) emvjson.Event {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Reader == reader {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("no event for %s", reader)
+			}
+		}
+	}
+
+	// the current state comes first.
+	if e := next(virtualReader.Name); e.Event != emvjson.EVENT_READER_ADDED {
+		t.Errorf("unexpected event: %v", e)
+	}
+
+	const name = "Virtual Reader Events"
+	expect := func(expected emvjson.Event) {
+		if e := next(name); e != expected {
+			t.Errorf("expected %v, got %v", expected, e)
+		}
+	}
+	rdr := virtual.AddReader(name)
+	expect(emvjson.Event{Event: emvjson.EVENT_READER_ADDED, Reader: name})
+	expect(emvjson.Event{Event: emvjson.EVENT_CARD_ABSENT, Reader: name})
+	rdr.Insert(emvjson.NewVirtualCard([]byte{0x3B, 0x04}, nil))
+	expect(emvjson.Event{Event: emvjson.EVENT_CARD_PRESENT, Reader: name, ATR: "3b04"})
+	rdr.Remove()
+	expect(emvjson.Event{Event: emvjson.EVENT_CARD_ABSENT, Reader: name})
+	virtual.RemoveReader(name)
+	expect(emvjson.Event{Event: emvjson.EVENT_READER_REMOVED, Reader: name})
+
+	if w := rest(t, &ScardHandler{}, nil, "POST", EVENTS_PATH, "", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST allowed: %d", w.Code)
+	}
+}
@@ -0,0 +1,203 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+import emvjson "emv/json"
+
+var virtual = emvjson.NewVirtualBackend()
+var virtualReader = virtual.AddReader("Virtual Reader 0")
+
+func init() {
+	virtualReader.Insert(emvjson.NewVirtualCard([]byte{0x3B, 0x00}, emvjson.Script(map[string]string{
+		"00A40000023F00": "9000",
+	})))
+	emvjson.SetBackend(virtual)
+}
+
+type noService struct{}
+
+func (noService) Version() string {
+	return "none"
+}
+
+func (noService) EstablishContext() (emvjson.BackendContext, error) {
+	return nil, scard.E_NO_SERVICE
+}
+
+// post sends body with the session cookie, if any.
+func post(t *testing.T, hdlr http.Handler, cookie *http.Cookie, body string, resp interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", SCARD_PATH, strings.NewReader(body))
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	hdlr.ServeHTTP(w, req)
+	if resp != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("%s: %s", err, w.Body)
+		}
+	}
+	return w
+}
+
+// sessionCookie returns the session cookie set by the response, or nil.
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == SESSION_COOKIE {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestScardHandler(t *testing.T) {
+	hdlr := &ScardHandler{}
+
+	ctx := emvjson.ScardContextResponse{}
+	w := post(t, hdlr, nil, `{"method":"establishContext"}`, &ctx)
+	if w.Code != http.StatusOK || ctx.Error != nil {
+		t.Fatalf("establishContext: %d %s", w.Code, w.Body)
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+	if ct := w.Header().Get("Content-Type"); ct != CONTENT_TYPE {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+
+	connect := `{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"EXCLUSIVE", "protocol":"ANY"}`
+	card := emvjson.ScardConnectResponse{}
+	if w = post(t, hdlr, cookie, fmt.Sprintf(connect, ctx.Ctx, virtualReader.Name), &card); w.Code != http.StatusOK || card.Error != nil {
+		t.Fatalf("connect: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"method":"version"}`, http.StatusOK},
+		{`{"method":`, http.StatusBadRequest},
+		{`{"method":"version", "unknown":1}`, http.StatusBadRequest},
+		{`{"method":"nonsense"}`, http.StatusNotFound},
+		{fmt.Sprintf(connect, ctx.Ctx, virtualReader.Name), http.StatusConflict},
+		{fmt.Sprintf(`{"method":"transmit", "ctx":"%s", "card":"%s", "data":"00A40000023F00"}`, ctx.Ctx, card.Card), http.StatusOK},
+		{`{"jsonrpc":"2.0", "id":1, "method":"nonsense"}`, http.StatusOK},
+		{`{"jsonrpc":"2.0", "method":"version"}`, http.StatusNoContent},
+		{`[{"method":"nonsense"}]`, http.StatusOK},
+		{`{"method":"version", "data":"` + strings.Repeat("00", int(emvjson.MaxRequestSize)) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		if w = post(t, hdlr, cookie, test.body, nil); w.Code != test.status {
+			t.Errorf("%.80s: expected %d, got %d: %.200s", test.body, test.status, w.Code, w.Body)
+		}
+	}
+
+	post(t, hdlr, cookie, fmt.Sprintf(`{"method":"releaseContext", "ctx":"%s"}`, ctx.Ctx), nil)
+}
+
+func TestScardHandlerNoService(t *testing.T) {
+	resp := emvjson.ScardContextResponse{}
+	w := post(t, &ScardHandler{Backend: noService{}}, nil, `{"method":"establishContext"}`, &resp)
+	if w.Code != http.StatusServiceUnavailable || !resp.Error.HasCode(scard.E_NO_SERVICE) {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestScardHandlerRestrictions(t *testing.T) {
+	hdlr := &ScardHandler{}
+
+	w := httptest.NewRecorder()
+	hdlr.ServeHTTP(w, httptest.NewRequest("GET", SCARD_PATH, nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST, DELETE" {
+		t.Errorf("GET allowed: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	hdlr.ServeHTTP(w, httptest.NewRequest("POST", SCARD_PATH+"EstablishContext", strings.NewReader(`{"method":"version"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unexpected status for unknown path: %d", w.Code)
+	}
+}
+
+func TestScardHandlerSessions(t *testing.T) {
+	hdlr := &ScardHandler{}
+
+	w := post(t, hdlr, nil, `{"method":"version"}`, nil)
+	if sessionCookie(w) != nil {
+		t.Error("session cookie without context")
+	}
+
+	ctx := emvjson.ScardContextResponse{}
+	cookie := sessionCookie(post(t, hdlr, nil, `{"method":"establishContext"}`, &ctx))
+	if cookie == nil || !cookie.Secure || !cookie.HttpOnly || cookie.Path != SCARD_PATH || cookie.MaxAge <= 0 {
+		t.Fatalf("unexpected session cookie: %v", cookie)
+	}
+	insecure := &ScardHandler{Insecure: true}
+	c := sessionCookie(post(t, insecure, nil, `{"method":"establishContext"}`, nil))
+	if c == nil || c.Secure {
+		t.Errorf("unexpected session cookie: %v", c)
+	}
+	defer rest(t, insecure, c, "DELETE", SCARD_PATH, "", nil)
+	other := sessionCookie(post(t, hdlr, nil, `{"method":"establishContext"}`, nil))
+	if other == nil || other.Value == cookie.Value {
+		t.Fatalf("unexpected session cookie: %v", other)
+	}
+
+	isValid := fmt.Sprintf(`{"method":"isValid", "ctx":"%s"}`, ctx.Ctx)
+	for _, c := range []*http.Cookie{nil, other} {
+		resp := emvjson.ScardResponse{}
+		post(t, hdlr, c, isValid, &resp)
+		if !resp.Error.HasCode(scard.E_INVALID_HANDLE) {
+			t.Errorf("context used outside of its session (%v): %v", c, resp.Error)
+		}
+	}
+	resp := emvjson.ScardResponse{}
+	if w = post(t, hdlr, cookie, isValid, &resp); resp.Error != nil || sessionCookie(w) == nil {
+		t.Errorf("context unusable in its session: %v", resp.Error)
+	}
+
+	// expired sessions are released.
+	hdlr.expire(time.Now().Add(SessionTimeout + time.Second))
+	if hdlr.lookup(httptest.NewRequest("POST", SCARD_PATH, nil)) != nil || len(hdlr.cookies) != 0 {
+		t.Errorf("sessions left: %d", len(hdlr.cookies))
+	}
+	resp = emvjson.ScardResponse{}
+	post(t, hdlr, cookie, isValid, &resp)
+	if resp.Error == nil {
+		t.Error("context of expired session still valid")
+	}
+}
+
+func TestScardHandlerRevoke(t *testing.T) {
+	hdlr := &ScardHandler{}
+
+	ctx := emvjson.ScardContextResponse{}
+	cookie := sessionCookie(post(t, hdlr, nil, `{"method":"establishContext"}`, &ctx))
+	if cookie == nil {
+		t.Fatal("no session cookie")
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", SCARD_PATH, nil)
+	req.AddCookie(cookie)
+	hdlr.ServeHTTP(w, req)
+	if revoked := sessionCookie(w); w.Code != http.StatusNoContent || revoked == nil || revoked.MaxAge >= 0 {
+		t.Errorf("unexpected response: %d %v", w.Code, revoked)
+	}
+
+	resp := emvjson.ScardResponse{}
+	post(t, hdlr, cookie, fmt.Sprintf(`{"method":"isValid", "ctx":"%s"}`, ctx.Ctx), &resp)
+	if resp.Error == nil {
+		t.Error("context of revoked session still valid")
+	}
+}
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+import emvjson "emv/json"
+
+// WebSocketMaxRequests limits the requests of a WebSocket running at
+// once, further requests are answered with SCARD_E_SERVER_TOO_BUSY until
+// one of them completes.
+var WebSocketMaxRequests = 16
+
+var errTooManyRequests = emvjson.NewScardError(scard.E_SERVER_TOO_BUSY, emvjson.CATEGORY_SERVICE_ERROR, "too many requests")
+
+// serveWebSocket speaks the JSON API over a WebSocket at WEBSOCKET_PATH.
+// Each text message is a request as POSTed to SCARD_PATH, flat requests
+// may carry an "id" which is returned in their response:
+//
+//	{"id":1, "method":"establishContext"}
+//	{"id":1, "ctx":"ctx_.."}
+//
+// Requests run concurrently (up to WebSocketMaxRequests), their responses
+// are sent as they complete.
+// Reader and card events (see emvjson.Subscribe) are pushed as
+//
+//	{"event":"CARD_PRESENT", "reader":"..", "atr":".."}
+//
+// Each socket has its own session, its contexts and cards are released
+// when the socket is closed, cancelling the requests still running.
+func (hdlr *ScardHandler) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	ws, err := upgradeWebSocket(w, req, emvjson.MaxRequestSize, WebSocketWriteTimeout)
+	if err != nil {
+		return
+	}
+	session := emvjson.NewSessionWithBackend(hdlr.Backend)
+	events := make(chan emvjson.Event, EventBuffer)
+	unsubscribe := emvjson.Subscribe(events)
+	done := make(chan bool)
+	// the event forwarder and the requests running.
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case e := <-events:
+				msg, _ := json.Marshal(e)
+				ws.WriteMessage(msg)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	running := make(chan bool, WebSocketMaxRequests)
+	reject := func(r io.Reader) interface{} {
+		return emvjson.RejectResponse(r, errTooManyRequests)
+	}
+	for {
+		var msg []byte
+		if msg, err = ws.ReadMessage(); err != nil {
+			break
+		}
+		select {
+		case running <- true:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-running }()
+				if resp := websocketResponse(msg, session.ScardJsonResponse); resp != nil {
+					ws.WriteMessage(resp)
+				}
+			}()
+		default:
+			// keep reading, the client may want to cancel or close.
+			if resp := websocketResponse(msg, reject); resp != nil {
+				ws.WriteMessage(resp)
+			}
+		}
+	}
+
+	close(done)
+	unsubscribe()
+	session.Close()
+	ws.Close(err)
+	wg.Wait()
+}
+
+// websocketResponse answers the request msg using run, returning the
+// response with the request's id or nil for JSON-RPC notifications.
+func websocketResponse(msg []byte, run func(io.Reader) interface{}) []byte {
+	var id json.RawMessage
+	fields := make(map[string]json.RawMessage)
+	// JSON-RPC requests have an id of their own.
+	if json.Unmarshal(msg, &fields) == nil && fields["id"] != nil && fields["jsonrpc"] == nil {
+		id = fields["id"]
+		delete(fields, "id")
+		msg, _ = json.Marshal(fields)
+	}
+
+	resp := run(bytes.NewReader(msg))
+	if resp == nil {
+		return nil
+	}
+	data, _ := json.Marshal(resp)
+	if id == nil {
+		return data
+	}
+	// flat responses are objects, put the id first.
+	withId := append([]byte(`{"id":`), id...)
+	if len(data) > 2 {
+		withId = append(withId, ',')
+	}
+	return append(withId, data[1:]...)
+}
@@ -0,0 +1,281 @@
+package http
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal server side implementation of the WebSocket protocol (RFC
+// 6455) as needed for the JSON API: no extensions, no subprotocols.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketWriteTimeout bounds sending a frame, connections of clients
+// not reading are closed.
+var WebSocketWriteTimeout = 10 * time.Second
+
+// frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// close status codes
+const (
+	closeNormal      = 1000
+	closeProtocol    = 1002
+	closeUnsupported = 1003
+	closeTooLarge    = 1009
+)
+
+type websocketError struct {
+	code    uint16
+	message string
+}
+
+func (e *websocketError) Error() string {
+	return e.message
+}
+
+var (
+	errMasking     = &websocketError{closeProtocol, "unmasked client frame"}
+	errFrame       = &websocketError{closeProtocol, "invalid frame"}
+	errBinary      = &websocketError{closeUnsupported, "binary messages not supported"}
+	errMessageSize = &websocketError{closeTooLarge, "message too large"}
+)
+
+// websocket is an established connection, messages may be written
+// concurrently but only be read by one goroutine.
+type websocket struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// serializes writes, nothing is sent after the close frame.
+	lock   sync.Mutex
+	closed bool
+	// maximum size of received messages.
+	limit int64
+	// bounds sending a frame.
+	timeout time.Duration
+}
+
+// upgradeWebSocket answers the WebSocket handshake of req. Requests from
+// other origins are refused, browsers don't restrict cross-origin
+// WebSockets. Failed handshakes are answered with an error status.
+// Messages are limited to limit bytes, sending a frame to timeout.
+func upgradeWebSocket(w http.ResponseWriter, req *http.Request, limit int64, timeout time.Duration) (ws *websocket, err error) {
+	fail := func(status int, message string) (*websocket, error) {
+		http.Error(w, message, status)
+		return nil, errors.New(message)
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case req.Method != "GET":
+		w.Header().Set("Allow", "GET")
+		return fail(http.StatusMethodNotAllowed, "method not allowed")
+	case !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") || key == "":
+		return fail(http.StatusBadRequest, "websocket handshake expected")
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusBadRequest, "unsupported websocket version")
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != req.Host {
+			return fail(http.StatusForbidden, "cross-origin websocket")
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocket{conn: conn, r: rw.Reader, limit: limit, timeout: timeout}, nil
+}
+
+// headerContains reports whether the comma separated header key contains
+// token, ignoring case.
+func headerContains(header http.Header, key, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readFrame reads a single frame and unmasks its payload.
+func (ws *websocket) readFrame() (fin bool, op byte, payload []byte, err error) {
+	header := make([]byte, 2, 8)
+	if _, err = io.ReadFull(ws.r, header); err != nil {
+		return
+	}
+	fin, op = header[0]&0x80 != 0, header[0]&0x0F
+	if header[0]&0x70 != 0 {
+		// no extensions were negotiated.
+		return false, 0, nil, errFrame
+	} else if header[1]&0x80 == 0 {
+		return false, 0, nil, errMasking
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		header = header[:2]
+		if _, err = io.ReadFull(ws.r, header); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(header))
+	case 127:
+		header = header[:8]
+		if _, err = io.ReadFull(ws.r, header); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(header)
+	}
+	if op >= opClose && (!fin || length > 125) {
+		return false, 0, nil, errFrame
+	} else if length > uint64(ws.limit) {
+		return false, 0, nil, errMessageSize
+	}
+
+	mask := make([]byte, 4)
+	if _, err = io.ReadFull(ws.r, mask); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next text message, answering control frames
+// meanwhile. It returns io.EOF once the client closed the connection.
+func (ws *websocket) ReadMessage() (msg []byte, err error) {
+	started := false
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err = ws.write(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return nil, io.EOF
+		case opBinary:
+			return nil, errBinary
+		case opText:
+			if started {
+				return nil, errFrame
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, errFrame
+			}
+		default:
+			return nil, errFrame
+		}
+
+		if msg = append(msg, payload...); int64(len(msg)) > ws.limit {
+			return nil, errMessageSize
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+var errClosed = errors.New("websocket closed")
+
+// write sends payload as single frame.
+func (ws *websocket) write(op byte, payload []byte) error {
+	header := []byte{0x80 | op, 0}
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.closed {
+		return errClosed
+	}
+	ws.closed = op == opClose
+	ws.conn.SetWriteDeadline(time.Now().Add(ws.timeout))
+	_, err := ws.conn.Write(header)
+	if err == nil {
+		_, err = ws.conn.Write(payload)
+	}
+	if err != nil {
+		// the frame may be cut short, the connection is unusable.
+		ws.closed = true
+		ws.conn.Close()
+	}
+	return err
+}
+
+// WriteMessage sends msg as text message.
+func (ws *websocket) WriteMessage(msg []byte) error {
+	return ws.write(opText, msg)
+}
+
+// Close closes the connection, telling the client why if err is a
+// protocol violation.
+func (ws *websocket) Close(err error) error {
+	code, reason := uint16(closeNormal), ""
+	if e, ok := err.(*websocketError); ok {
+		code, reason = e.code, e.message
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	ws.write(opClose, append(payload, reason...))
+	return ws.conn.Close()
+}
@@ -0,0 +1,304 @@
+package http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+import emvjson "emv/json"
+
+// wsClient is the client side of a WebSocket for testing.
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server) *wsClient {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		WEBSOCKET_PATH, server.Listener.Addr())
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the example of RFC 6455
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake failed: %s %v", resp.Status, resp.Header)
+	}
+	return &wsClient{conn, r}
+}
+
+// send writes a masked frame.
+func (c *wsClient) send(t *testing.T, fin bool, op byte, payload string) {
+	header := []byte{op, 0x80 | byte(len(payload))}
+	if fin {
+		header[0] |= 0x80
+	}
+	if len(payload) >= 126 {
+		header[1] = 0x80 | 126
+		header = append(header, byte(len(payload)>>8), byte(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	data := []byte(payload)
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+	if _, err := c.conn.Write(append(append(header, mask...), data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads an unfragmented frame.
+func (c *wsClient) receive(t *testing.T) (op byte, payload []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1])
+	if length == 126 {
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, extended); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// response returns the next message that isn't an event.
+func (c *wsClient) response(t *testing.T, resp interface{}) {
+	for {
+		op, payload := c.receive(t)
+		if op != opText {
+			t.Fatalf("unexpected frame %x: %q", op, payload)
+		}
+		if !strings.HasPrefix(string(payload), `{"event":`) {
+			if err := json.Unmarshal(payload, resp); err != nil {
+				t.Fatalf("%s: %s", err, payload)
+			}
+			return
+		}
+	}
+}
+
+// event returns the next event of reader.
+func (c *wsClient) event(t *testing.T, reader string) (e emvjson.Event) {
+	for {
+		op, payload := c.receive(t)
+		if op != opText {
+			t.Fatalf("unexpected frame %x: %q", op, payload)
+		}
+		if json.Unmarshal(payload, &e) == nil && e.Reader == reader {
+			return
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	server := httptest.NewServer(&ScardHandler{})
+	defer server.Close()
+	c := dialWebSocket(t, server)
+
+	var ctx struct {
+		Id int `json:"id"`
+		emvjson.ScardContextResponse
+	}
+	c.send(t, true, opText, `{"id":7, "method":"establishContext"}`)
+	if c.response(t, &ctx); ctx.Id != 7 || ctx.Error != nil || ctx.Ctx == "" {
+		t.Fatalf("unexpected response: %+v", ctx)
+	}
+
+	// fragmented, with a ping in between.
+	connect := fmt.Sprintf(`{"id":"c", "method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"EXCLUSIVE", "protocol":"ANY"}`, ctx.Ctx, virtualReader.Name)
+	c.send(t, false, opText, connect[:10])
+	c.send(t, true, opPing, "ping")
+	if op, payload := c.receive(t); op != opPong || string(payload) != "ping" {
+		t.Errorf("unexpected answer to ping: %x %q", op, payload)
+	}
+	c.send(t, true, opContinuation, connect[10:])
+	var card struct {
+		Id string `json:"id"`
+		emvjson.ScardConnectResponse
+	}
+	if c.response(t, &card); card.Id != "c" || card.Error != nil {
+		t.Fatalf("unexpected response: %+v", card)
+	}
+
+	var rpc emvjson.JsonRpcResponse
+	c.send(t, true, opText, `{"jsonrpc":"2.0", "id":8, "method":"version"}`)
+	if c.response(t, &rpc); string(rpc.Id) != "8" || rpc.Error != nil {
+		t.Errorf("unexpected response: %+v", rpc)
+	}
+
+	// events are pushed.
+	const name = "Virtual Reader WebSocket"
+	rdr := virtual.AddReader(name)
+	defer virtual.RemoveReader(name)
+	if e := c.event(t, name); e.Event != emvjson.EVENT_READER_ADDED {
+		t.Errorf("unexpected event: %v", e)
+	}
+	if e := c.event(t, name); e.Event != emvjson.EVENT_CARD_ABSENT {
+		t.Errorf("unexpected event: %v", e)
+	}
+	rdr.Insert(emvjson.NewVirtualCard([]byte{0x3B, 0x03}, nil))
+	if e := c.event(t, name); e.Event != emvjson.EVENT_CARD_PRESENT || e.ATR != "3b03" {
+		t.Errorf("unexpected event: %v", e)
+	}
+
+	// closing the socket releases its card.
+	c.send(t, true, opClose, "\x03\xe8")
+	if op, _ := c.receive(t); op != opClose {
+		t.Errorf("close not answered: %x", op)
+	}
+	c.conn.Close()
+
+	hdlr := &ScardHandler{}
+	resp := emvjson.ScardContextResponse{}
+	cookie := sessionCookie(post(t, hdlr, nil, `{"method":"establishContext"}`, &resp))
+	defer rest(t, hdlr, cookie, "DELETE", SCARD_PATH, "", nil)
+	connect = fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"EXCLUSIVE", "protocol":"ANY"}`, resp.Ctx, virtualReader.Name)
+	for i := 0; ; i++ {
+		if w := post(t, hdlr, cookie, connect, nil); w.Code == http.StatusOK {
+			break
+		} else if i == 50 {
+			t.Fatalf("card of closed socket not released: %d %s", w.Code, w.Body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	server := httptest.NewServer(&ScardHandler{})
+	defer server.Close()
+
+	for _, test := range []struct {
+		header http.Header
+		status int
+	}{
+		{http.Header{}, http.StatusBadRequest},
+		{http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Key": {"x"}, "Sec-Websocket-Version": {"8"}}, http.StatusBadRequest},
+		{http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Key": {"x"}, "Sec-Websocket-Version": {"13"}, "Origin": {"http://example.com"}}, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+WEBSOCKET_PATH, nil)
+		for key, values := range test.header {
+			req.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: expected %d, got %d", test.header, test.status, resp.StatusCode)
+		}
+	}
+
+	// unmasked frames are a protocol error.
+	c := dialWebSocket(t, server)
+	defer c.conn.Close()
+	c.conn.Write([]byte{0x81, 0x02, '{', '}'})
+	op, payload := c.receive(t)
+	for op == opText {
+		// events sent before
+		op, payload = c.receive(t)
+	}
+	if op != opClose || binary.BigEndian.Uint16(payload) != closeProtocol {
+		t.Errorf("unexpected answer to unmasked frame: %x %q", op, payload)
+	}
+}
+
+func TestWebSocketMaxRequests(t *testing.T) {
+	defer func(max int) { WebSocketMaxRequests = max }(WebSocketMaxRequests)
+	WebSocketMaxRequests = 1
+	hdlr := &ScardHandler{}
+	exited := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hdlr.ServeHTTP(w, req)
+		if req.URL.Path == WEBSOCKET_PATH {
+			close(exited)
+		}
+	}))
+	defer server.Close()
+	c := dialWebSocket(t, server)
+	defer c.conn.Close()
+
+	const name = "Virtual Reader WebSocket Requests"
+	virtual.AddReader(name)
+	defer virtual.RemoveReader(name)
+
+	var ctx emvjson.ScardContextResponse
+	c.send(t, true, opText, `{"method":"establishContext"}`)
+	if c.response(t, &ctx); ctx.Error != nil {
+		t.Fatalf("establishContext: %s", ctx.Error)
+	}
+
+	// waits forever, further requests are turned down meanwhile.
+	c.send(t, true, opText, fmt.Sprintf(`{"id":1, "method":"getStatusChange", "ctx":"%s", "timeout":-1, "readerStates":[{"reader":"%s", "currentState":%d}]}`,
+		ctx.Ctx, name, scard.STATE_EMPTY))
+	var busy struct {
+		Id    int                 `json:"id"`
+		Error *emvjson.ScardError `json:"error"`
+	}
+	for i := 0; busy.Id != 2; i++ {
+		if i == 50 {
+			t.Fatal("getStatusChange not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+		c.send(t, true, opText, `{"id":2, "method":"version"}`)
+		c.response(t, &busy)
+	}
+	if !busy.Error.HasCode(scard.E_SERVER_TOO_BUSY) {
+		t.Errorf("unexpected response: %+v", busy)
+	}
+	var rpc emvjson.JsonRpcResponse
+	c.send(t, true, opText, `{"jsonrpc":"2.0", "id":3, "method":"version"}`)
+	if c.response(t, &rpc); string(rpc.Id) != "3" || rpc.Error == nil || !rpc.Error.Data.HasCode(scard.E_SERVER_TOO_BUSY) {
+		t.Errorf("unexpected response: %+v", rpc)
+	}
+
+	// closing the socket cancels the wait and releases the context.
+	c.conn.Close()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't exit")
+	}
+	resp := emvjson.ScardJsonResponse(strings.NewReader(fmt.Sprintf(`{"method":"isValid", "ctx":"%s"}`, ctx.Ctx)))
+	if e := emvjson.ResponseError(resp); !e.HasCode(scard.E_INVALID_HANDLE) {
+		t.Errorf("context of closed socket still valid: %v", e)
+	}
+}
+
+func TestWebSocketWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// the client doesn't read.
+	ws := &websocket{conn: server, r: bufio.NewReader(server), limit: 1024, timeout: 50 * time.Millisecond}
+	if err := ws.WriteMessage([]byte("{}")); err == nil {
+		t.Fatal("write to stalled client succeeded")
+	}
+	if err := ws.WriteMessage([]byte("{}")); err != errClosed {
+		t.Errorf("write after timeout: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package json
+
+import (
+	"sync"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// Backend is what the JSON layer uses to talk to PC/SC. The default is
+// the local pcsc-lite daemon (PcscBackend), tests and special
+// deployments plug in their own with SetBackend.
+//
+// Backends report errors as scard.Error where PC/SC would have returned
+// an error code.
+type Backend interface {
+	Version() string
+	EstablishContext() (BackendContext, error)
+}
+
+// BackendContext corresponds to an SCARDCONTEXT.
+type BackendContext interface {
+	Release() error
+	IsValid() (bool, error)
+	Cancel() error
+	ListReaders() ([]string, error)
+	ListReaderGroups() ([]string, error)
+	GetStatusChange(readerStates []scard.ReaderState, timeout time.Duration) error
+	Connect(reader string, mode scard.ShareMode, proto scard.Protocol) (BackendCard, error)
+}
+
+// BackendCard corresponds to an SCARDHANDLE.
+type BackendCard interface {
+	Disconnect(d scard.Disposition) error
+	Reconnect(mode scard.ShareMode, proto scard.Protocol, d scard.Disposition) error
+	BeginTransaction() error
+	EndTransaction(d scard.Disposition) error
+	Status() (*scard.CardStatus, error)
+	Transmit(cmd []byte) ([]byte, error)
+	Control(code uint32, cmd []byte) ([]byte, error)
+	GetAttrib(id scard.Attrib) ([]byte, error)
+	SetAttrib(id scard.Attrib, data []byte) error
+}
+
+var backendLock sync.RWMutex
+var backend Backend = PcscBackend{}
+
+// SetBackend replaces the default backend, used by requests outside of
+// sessions, sessions without a backend of their own and the monitor.
+// Handles established with the previous backend stay registered.
+func SetBackend(b Backend) {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	backend = b
+}
+
+// DefaultBackend returns the backend set by SetBackend.
+func DefaultBackend() Backend {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+	return backend
+}
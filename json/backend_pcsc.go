@@ -0,0 +1,32 @@
+package json
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// PcscBackend talks to the local pcsc-lite daemon.
+type PcscBackend struct{}
+
+func (PcscBackend) Version() string {
+	return scard.Version()
+}
+
+func (PcscBackend) EstablishContext() (BackendContext, error) {
+	ctx, err := scard.EstablishContext()
+	if err != nil {
+		return nil, err
+	}
+	return pcscContext{ctx}, nil
+}
+
+// pcscContext only exists because scard.Context.Connect returns a
+// *scard.Card instead of a BackendCard.
+type pcscContext struct {
+	*scard.Context
+}
+
+func (ctx pcscContext) Connect(reader string, mode scard.ShareMode, proto scard.Protocol) (BackendCard, error) {
+	card, err := ctx.Context.Connect(reader, mode, proto)
+	if err != nil {
+		return nil, err
+	}
+	return card, nil
+}
@@ -0,0 +1,539 @@
+package json
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// RecordedCall is a single PC/SC call as written by RecordingBackend, one
+// JSON object per line.
+type RecordedCall struct {
+	// "backend" or the id of the context ("ctx0", "ctx1", ...) or card
+	// ("card0", ...) the method was called on.
+	Handle string `json:"handle"`
+	Method string `json:"method"`
+	// the order in which the calls started, they are logged when they
+	// return.
+	Seq    int             `json:"seq"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	// scard.Error code, or the text of any other error.
+	Error     uint32        `json:"error,omitempty"`
+	ErrorText string        `json:"errorText,omitempty"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+}
+
+func (c *RecordedCall) err() error {
+	switch {
+	case c.Error != 0:
+		return scard.Error(c.Error)
+	case c.ErrorText != "":
+		return errors.New(c.ErrorText)
+	}
+	return nil
+}
+
+// hexBytes are recorded as hex strings instead of base64.
+type hexBytes []byte
+
+func (h hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *hexBytes) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	*h, err = hex.DecodeString(s)
+	return
+}
+
+type recordedReaderState struct {
+	Reader       string          `json:"reader"`
+	CurrentState scard.StateFlag `json:"currentState"`
+	EventState   scard.StateFlag `json:"eventState"`
+	ATR          hexBytes        `json:"atr"`
+}
+
+func recordReaderStates(states []scard.ReaderState) []recordedReaderState {
+	recorded := make([]recordedReaderState, len(states))
+	for i, rs := range states {
+		recorded[i] = recordedReaderState{rs.Reader, rs.CurrentState, rs.EventState, rs.Atr}
+	}
+	return recorded
+}
+
+type recordedStatusChange struct {
+	ReaderStates []recordedReaderState `json:"readerStates"`
+	Timeout      time.Duration         `json:"timeout"`
+}
+
+type recordedConnect struct {
+	Reader    string          `json:"reader"`
+	ShareMode scard.ShareMode `json:"shareMode"`
+	Protocol  scard.Protocol  `json:"protocol"`
+}
+
+type recordedReconnect struct {
+	ShareMode   scard.ShareMode   `json:"shareMode"`
+	Protocol    scard.Protocol    `json:"protocol"`
+	Disposition scard.Disposition `json:"disposition"`
+}
+
+type recordedStatus struct {
+	Reader         string         `json:"reader"`
+	State          scard.State    `json:"state"`
+	ActiveProtocol scard.Protocol `json:"activeProtocol"`
+	ATR            hexBytes       `json:"atr"`
+}
+
+type recordedControl struct {
+	Code uint32   `json:"code"`
+	Data hexBytes `json:"data"`
+}
+
+type recordedSetAttrib struct {
+	Attrib scard.Attrib `json:"attrib"`
+	Data   hexBytes     `json:"data"`
+}
+
+// RecordingBackend logs every call made to the wrapped backend so the
+// session can later be reproduced with a ReplayBackend:
+//
+//	f, _ := os.Create("session.log")
+//	SetBackend(NewRecordingBackend(PcscBackend{}, f))
+type RecordingBackend struct {
+	backend Backend
+
+	lock sync.Mutex
+	enc  *json.Encoder
+	ids  map[string]int
+	seq  int
+	// first error writing the log, recording stops afterwards.
+	err error
+}
+
+func NewRecordingBackend(b Backend, w io.Writer) *RecordingBackend {
+	return &RecordingBackend{
+		backend: b,
+		enc:     json.NewEncoder(w),
+		ids:     make(map[string]int),
+	}
+}
+
+// Err returns the first error that occurred writing the log.
+func (r *RecordingBackend) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+// newId returns the next id for a handle of kind ("ctx" or "card").
+func (r *RecordingBackend) newId(kind string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := fmt.Sprintf("%s%d", kind, r.ids[kind])
+	r.ids[kind]++
+	return id
+}
+
+// callStart identifies a call in progress.
+type callStart struct {
+	seq int
+	at  time.Time
+}
+
+// begin numbers a call about to be made.
+func (r *RecordingBackend) begin() callStart {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.seq++
+	return callStart{r.seq, time.Now()}
+}
+
+func (r *RecordingBackend) record(handle, method string, params interface{}, start callStart, result interface{}, err error) {
+	call := RecordedCall{
+		Handle:   handle,
+		Method:   method,
+		Seq:      start.seq,
+		Start:    start.at,
+		Duration: time.Since(start.at),
+	}
+	if se, ok := err.(scard.Error); ok {
+		call.Error = uint32(se)
+	} else if err != nil {
+		call.ErrorText = err.Error()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	if params != nil {
+		if call.Params, r.err = json.Marshal(params); r.err != nil {
+			return
+		}
+	}
+	if result != nil && err == nil {
+		if call.Result, r.err = json.Marshal(result); r.err != nil {
+			return
+		}
+	}
+	r.err = r.enc.Encode(call)
+}
+
+func (r *RecordingBackend) Version() string {
+	start := r.begin()
+	version := r.backend.Version()
+	r.record("backend", "version", nil, start, version, nil)
+	return version
+}
+
+func (r *RecordingBackend) EstablishContext() (BackendContext, error) {
+	start := r.begin()
+	ctx, err := r.backend.EstablishContext()
+	if err != nil {
+		r.record("backend", "establishContext", nil, start, nil, err)
+		return nil, err
+	}
+	id := r.newId("ctx")
+	r.record("backend", "establishContext", nil, start, id, nil)
+	return &recordingContext{ctx, id, r}, nil
+}
+
+type recordingContext struct {
+	ctx BackendContext
+	id  string
+	rec *RecordingBackend
+}
+
+func (c *recordingContext) Release() (err error) {
+	start := c.rec.begin()
+	err = c.ctx.Release()
+	c.rec.record(c.id, "release", nil, start, nil, err)
+	return
+}
+
+func (c *recordingContext) IsValid() (valid bool, err error) {
+	start := c.rec.begin()
+	valid, err = c.ctx.IsValid()
+	c.rec.record(c.id, "isValid", nil, start, valid, err)
+	return
+}
+
+func (c *recordingContext) Cancel() (err error) {
+	start := c.rec.begin()
+	err = c.ctx.Cancel()
+	c.rec.record(c.id, "cancel", nil, start, nil, err)
+	return
+}
+
+func (c *recordingContext) ListReaders() (readers []string, err error) {
+	start := c.rec.begin()
+	readers, err = c.ctx.ListReaders()
+	c.rec.record(c.id, "listReaders", nil, start, readers, err)
+	return
+}
+
+func (c *recordingContext) ListReaderGroups() (groups []string, err error) {
+	start := c.rec.begin()
+	groups, err = c.ctx.ListReaderGroups()
+	c.rec.record(c.id, "listReaderGroups", nil, start, groups, err)
+	return
+}
+
+func (c *recordingContext) GetStatusChange(readerStates []scard.ReaderState, timeout time.Duration) (err error) {
+	params := recordedStatusChange{recordReaderStates(readerStates), timeout}
+	start := c.rec.begin()
+	err = c.ctx.GetStatusChange(readerStates, timeout)
+	c.rec.record(c.id, "getStatusChange", params, start, recordReaderStates(readerStates), err)
+	return
+}
+
+func (c *recordingContext) Connect(reader string, mode scard.ShareMode, proto scard.Protocol) (BackendCard, error) {
+	params := recordedConnect{reader, mode, proto}
+	start := c.rec.begin()
+	card, err := c.ctx.Connect(reader, mode, proto)
+	if err != nil {
+		c.rec.record(c.id, "connect", params, start, nil, err)
+		return nil, err
+	}
+	id := c.rec.newId("card")
+	c.rec.record(c.id, "connect", params, start, id, nil)
+	return &recordingCard{card, id, c.rec}, nil
+}
+
+type recordingCard struct {
+	card BackendCard
+	id   string
+	rec  *RecordingBackend
+}
+
+func (c *recordingCard) Disconnect(d scard.Disposition) (err error) {
+	start := c.rec.begin()
+	err = c.card.Disconnect(d)
+	c.rec.record(c.id, "disconnect", d, start, nil, err)
+	return
+}
+
+func (c *recordingCard) Reconnect(mode scard.ShareMode, proto scard.Protocol, d scard.Disposition) (err error) {
+	start := c.rec.begin()
+	err = c.card.Reconnect(mode, proto, d)
+	c.rec.record(c.id, "reconnect", recordedReconnect{mode, proto, d}, start, nil, err)
+	return
+}
+
+func (c *recordingCard) BeginTransaction() (err error) {
+	start := c.rec.begin()
+	err = c.card.BeginTransaction()
+	c.rec.record(c.id, "beginTransaction", nil, start, nil, err)
+	return
+}
+
+func (c *recordingCard) EndTransaction(d scard.Disposition) (err error) {
+	start := c.rec.begin()
+	err = c.card.EndTransaction(d)
+	c.rec.record(c.id, "endTransaction", d, start, nil, err)
+	return
+}
+
+func (c *recordingCard) Status() (status *scard.CardStatus, err error) {
+	start := c.rec.begin()
+	status, err = c.card.Status()
+	var result *recordedStatus
+	if err == nil {
+		result = &recordedStatus{status.Reader, status.State, status.ActiveProtocol, status.ATR}
+	}
+	c.rec.record(c.id, "status", nil, start, result, err)
+	return
+}
+
+func (c *recordingCard) Transmit(cmd []byte) (resp []byte, err error) {
+	start := c.rec.begin()
+	resp, err = c.card.Transmit(cmd)
+	c.rec.record(c.id, "transmit", hexBytes(cmd), start, hexBytes(resp), err)
+	return
+}
+
+func (c *recordingCard) Control(code uint32, in []byte) (out []byte, err error) {
+	start := c.rec.begin()
+	out, err = c.card.Control(code, in)
+	c.rec.record(c.id, "control", recordedControl{code, in}, start, hexBytes(out), err)
+	return
+}
+
+func (c *recordingCard) GetAttrib(id scard.Attrib) (data []byte, err error) {
+	start := c.rec.begin()
+	data, err = c.card.GetAttrib(id)
+	c.rec.record(c.id, "getAttrib", id, start, hexBytes(data), err)
+	return
+}
+
+func (c *recordingCard) SetAttrib(id scard.Attrib, data []byte) (err error) {
+	start := c.rec.begin()
+	err = c.card.SetAttrib(id, data)
+	c.rec.record(c.id, "setAttrib", recordedSetAttrib{id, data}, start, nil, err)
+	return
+}
+
+// ReplayBackend answers calls from a log written by RecordingBackend. The
+// calls have to arrive in the order they were started in with the
+// recorded parameters, otherwise the call fails with a replay error
+// describing the mismatch. Timing is not reproduced, e.g. a recorded
+// getStatusChange which was cancelled returns E_CANCELLED right away.
+type ReplayBackend struct {
+	lock  sync.Mutex
+	calls []RecordedCall
+	next  int
+}
+
+func NewReplayBackend(r io.Reader) (*ReplayBackend, error) {
+	b := &ReplayBackend{}
+	decoder := json.NewDecoder(r)
+	for {
+		call := RecordedCall{}
+		if err := decoder.Decode(&call); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		b.calls = append(b.calls, call)
+	}
+	sort.SliceStable(b.calls, func(i, j int) bool {
+		return b.calls[i].Seq < b.calls[j].Seq
+	})
+	return b, nil
+}
+
+// Remaining returns the number of recorded calls not replayed yet.
+func (b *ReplayBackend) Remaining() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.calls) - b.next
+}
+
+// replay checks the next recorded call matches and unmarshals its result
+// into result, returning the recorded error.
+func (b *ReplayBackend) replay(handle, method string, params interface{}, result interface{}) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.next == len(b.calls) {
+		return fmt.Errorf("replay: unexpected call %s.%s, no more recorded calls", handle, method)
+	}
+	call := &b.calls[b.next]
+	if call.Handle != handle || call.Method != method {
+		return fmt.Errorf("replay: unexpected call %s.%s, recorded %s.%s", handle, method, call.Handle, call.Method)
+	}
+	if params != nil {
+		actual, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		recorded := bytes.Buffer{}
+		if err = json.Compact(&recorded, call.Params); err != nil {
+			return err
+		}
+		if !bytes.Equal(actual, recorded.Bytes()) {
+			return fmt.Errorf("replay: %s.%s called with %s, recorded %s", handle, method, actual, call.Params)
+		}
+	}
+	b.next++
+
+	if result != nil && call.Result != nil {
+		if err := json.Unmarshal(call.Result, result); err != nil {
+			return err
+		}
+	}
+	return call.err()
+}
+
+func (b *ReplayBackend) Version() (version string) {
+	b.replay("backend", "version", nil, &version)
+	return
+}
+
+func (b *ReplayBackend) EstablishContext() (BackendContext, error) {
+	var id string
+	if err := b.replay("backend", "establishContext", nil, &id); err != nil {
+		return nil, err
+	}
+	return &replayContext{b, id}, nil
+}
+
+type replayContext struct {
+	backend *ReplayBackend
+	id      string
+}
+
+func (c *replayContext) Release() error {
+	return c.backend.replay(c.id, "release", nil, nil)
+}
+
+func (c *replayContext) IsValid() (valid bool, err error) {
+	err = c.backend.replay(c.id, "isValid", nil, &valid)
+	return
+}
+
+func (c *replayContext) Cancel() error {
+	return c.backend.replay(c.id, "cancel", nil, nil)
+}
+
+func (c *replayContext) ListReaders() (readers []string, err error) {
+	err = c.backend.replay(c.id, "listReaders", nil, &readers)
+	return
+}
+
+func (c *replayContext) ListReaderGroups() (groups []string, err error) {
+	err = c.backend.replay(c.id, "listReaderGroups", nil, &groups)
+	return
+}
+
+func (c *replayContext) GetStatusChange(readerStates []scard.ReaderState, timeout time.Duration) error {
+	params := recordedStatusChange{recordReaderStates(readerStates), timeout}
+	var result []recordedReaderState
+	err := c.backend.replay(c.id, "getStatusChange", params, &result)
+	for i := range result {
+		if i < len(readerStates) {
+			readerStates[i].EventState = result[i].EventState
+			readerStates[i].Atr = result[i].ATR
+		}
+	}
+	return err
+}
+
+func (c *replayContext) Connect(reader string, mode scard.ShareMode, proto scard.Protocol) (BackendCard, error) {
+	var id string
+	if err := c.backend.replay(c.id, "connect", recordedConnect{reader, mode, proto}, &id); err != nil {
+		return nil, err
+	}
+	return &replayCard{c.backend, id}, nil
+}
+
+type replayCard struct {
+	backend *ReplayBackend
+	id      string
+}
+
+func (c *replayCard) Disconnect(d scard.Disposition) error {
+	return c.backend.replay(c.id, "disconnect", d, nil)
+}
+
+func (c *replayCard) Reconnect(mode scard.ShareMode, proto scard.Protocol, d scard.Disposition) error {
+	return c.backend.replay(c.id, "reconnect", recordedReconnect{mode, proto, d}, nil)
+}
+
+func (c *replayCard) BeginTransaction() error {
+	return c.backend.replay(c.id, "beginTransaction", nil, nil)
+}
+
+func (c *replayCard) EndTransaction(d scard.Disposition) error {
+	return c.backend.replay(c.id, "endTransaction", d, nil)
+}
+
+func (c *replayCard) Status() (*scard.CardStatus, error) {
+	result := recordedStatus{}
+	if err := c.backend.replay(c.id, "status", nil, &result); err != nil {
+		return nil, err
+	}
+	return &scard.CardStatus{
+		Reader:         result.Reader,
+		State:          result.State,
+		ActiveProtocol: result.ActiveProtocol,
+		ATR:            result.ATR,
+	}, nil
+}
+
+func (c *replayCard) Transmit(cmd []byte) (resp []byte, err error) {
+	var result hexBytes
+	err = c.backend.replay(c.id, "transmit", hexBytes(cmd), &result)
+	return result, err
+}
+
+func (c *replayCard) Control(code uint32, in []byte) (out []byte, err error) {
+	var result hexBytes
+	err = c.backend.replay(c.id, "control", recordedControl{code, in}, &result)
+	return result, err
+}
+
+func (c *replayCard) GetAttrib(id scard.Attrib) (data []byte, err error) {
+	var result hexBytes
+	err = c.backend.replay(c.id, "getAttrib", id, &result)
+	return result, err
+}
+
+func (c *replayCard) SetAttrib(id scard.Attrib, data []byte) error {
+	return c.backend.replay(c.id, "setAttrib", recordedSetAttrib{id, data}, nil)
+}
@@ -0,0 +1,151 @@
+package json
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// session runs a typical client session and returns the transmit
+// response.
+func session(t *testing.T) string {
+	context := ScardContextResponse{}
+	virtualCall(t, `{"method":"establishContext"}`, &context)
+	if context.Error != nil {
+		t.Fatalf("establishContext: %s", context.Error)
+	}
+	ctx := context.Ctx
+
+	list := ScardListReadersResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"listReaders", "ctx":"%s"}`, ctx), &list)
+	if list.Error != nil {
+		t.Fatalf("listReaders: %s", list.Error)
+	}
+
+	connect := ScardConnectResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, list.Readers[0]), &connect)
+	if connect.Error != nil {
+		t.Fatalf("connect: %s", connect.Error)
+	}
+
+	transmit := ScardTransmitResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"transmit", "ctx":"%s", "card":"%s", "data":"00A404000E315041592E5359532E444446303100"}`, ctx, connect.Card), &transmit)
+	if transmit.Error != nil {
+		t.Fatalf("transmit: %s", transmit.Error)
+	}
+
+	release := ScardResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"releaseContext", "ctx":"%s", "disposition":"LEAVE_CARD"}`, ctx), &release)
+	if release.Error != nil {
+		t.Fatalf("releaseContext: %s", release.Error)
+	}
+	return transmit.Data
+}
+
+func TestRecordReplay(t *testing.T) {
+	defer SetBackend(DefaultBackend())
+
+	log := &bytes.Buffer{}
+	recorder := NewRecordingBackend(virtual, log)
+	SetBackend(recorder)
+	recorded := session(t)
+	if err := recorder.Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("log:\n%s", log.String())
+
+	replay, err := NewReplayBackend(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetBackend(replay)
+	if replayed := session(t); replayed != recorded {
+		t.Errorf("replayed %s, recorded %s", replayed, recorded)
+	}
+	if replay.Remaining() != 0 {
+		t.Errorf("%d calls not replayed", replay.Remaining())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	log := `{"handle":"backend","method":"establishContext","result":"ctx0"}
+{"handle":"ctx0","method":"connect","params":{"reader":"A","shareMode":2,"protocol":3},"result":"card0"}
+`
+	replay, err := NewReplayBackend(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := replay.EstablishContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ctx.Connect("B", 2, 3); err == nil {
+		t.Error("expected error for different reader")
+	}
+	if _, err = ctx.ListReaders(); err == nil {
+		t.Error("expected error for unexpected method")
+	}
+}
+
+// cancelSession blocks in getStatusChange until it's cancelled.
+func cancelSession(t *testing.T) *ScardError {
+	context := ScardContextResponse{}
+	virtualCall(t, `{"method":"establishContext"}`, &context)
+	if context.Error != nil {
+		t.Fatalf("establishContext: %s", context.Error)
+	}
+	ctx := context.Ctx
+	defer virtualCall(t, fmt.Sprintf(`{"method":"releaseContext", "ctx":"%s"}`, ctx), &ScardResponse{})
+
+	getStatusChange := `{"method":"getStatusChange", "ctx":"%s", "timeout":%d, "readerStates":[{"reader":"%s", "currentState":%d}]}`
+	current := ScardGetStatusChangeResponse{}
+	virtualCall(t, fmt.Sprintf(getStatusChange, ctx, 0, virtualReader.Name, scard.STATE_UNAWARE), &current)
+	if current.Error != nil {
+		t.Fatalf("getStatusChange: %s", current.Error)
+	}
+	state := current.ReaderStates[0].EventState &^ uint32(scard.STATE_CHANGED)
+
+	done := make(chan *ScardError, 1)
+	go func() {
+		resp := ScardGetStatusChangeResponse{}
+		virtualCall(t, fmt.Sprintf(getStatusChange, ctx, -1, virtualReader.Name, state), &resp)
+		done <- resp.Error
+	}()
+	select {
+	case e := <-done:
+		// replayed right away.
+		virtualCall(t, fmt.Sprintf(`{"method":"cancel", "ctx":"%s"}`, ctx), &ScardResponse{})
+		return e
+	case <-time.After(50 * time.Millisecond):
+	}
+	virtualCall(t, fmt.Sprintf(`{"method":"cancel", "ctx":"%s"}`, ctx), &ScardResponse{})
+	return <-done
+}
+
+func TestRecordReplayCancel(t *testing.T) {
+	defer SetBackend(DefaultBackend())
+
+	log := &bytes.Buffer{}
+	recorder := NewRecordingBackend(virtual, log)
+	SetBackend(recorder)
+	if e := cancelSession(t); !e.HasCode(scard.E_CANCELLED) {
+		t.Fatalf("getStatusChange not cancelled: %v", e)
+	}
+	t.Logf("log:\n%s", log.String())
+
+	replay, err := NewReplayBackend(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetBackend(replay)
+	if e := cancelSession(t); !e.HasCode(scard.E_CANCELLED) {
+		t.Errorf("unexpected replayed error: %v", e)
+	}
+	if replay.Remaining() != 0 {
+		t.Errorf("%d calls not replayed", replay.Remaining())
+	}
+}
@@ -0,0 +1,528 @@
+package json
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// RemoteBackend forwards PC/SC calls to other pcsc_backend instances
+// using the JSON protocol over HTTP, so readers attached to different
+// hosts can be used through a single front server.
+//
+// Each remote is identified by a namespace, reader names are prefixed
+// with the namespace and REMOTE_SEPARATOR ("host1:SCM SCR 3310 00 00").
+// A context established through the RemoteBackend holds a context on
+// every remote and listReaders aggregates the readers of all of them.
+// The remote context and card tokens never leave the front server, the
+// client only sees the tokens issued by the front server's registry.
+//
+// Remotes served by emv/http bind tokens to a session cookie, the backend
+// keeps the cookies of each remote in a jar of its own.
+type RemoteBackend struct {
+	// namespace -> URL of the remote's JSON endpoint.
+	remotes map[string]string
+	// namespace -> the remote's session cookie.
+	jars map[string]http.CookieJar
+	// Client sends the requests, its Jar is ignored.
+	Client *http.Client
+}
+
+const REMOTE_SEPARATOR = ":"
+
+// NewRemoteBackend creates a backend forwarding to remotes, which maps
+// namespaces (which may not contain REMOTE_SEPARATOR) to the URL the
+// remote's ScardJson is served under.
+func NewRemoteBackend(remotes map[string]string) *RemoteBackend {
+	for namespace := range remotes {
+		if strings.Contains(namespace, REMOTE_SEPARATOR) {
+			panic("invalid namespace: " + namespace)
+		}
+	}
+	jars := make(map[string]http.CookieJar, len(remotes))
+	for namespace := range remotes {
+		// only fails for invalid options.
+		jars[namespace], _ = cookiejar.New(nil)
+	}
+	return &RemoteBackend{remotes: remotes, jars: jars, Client: http.DefaultClient}
+}
+
+// namespaces returns the namespaces in a stable order.
+func (b *RemoteBackend) namespaces() []string {
+	namespaces := make([]string, 0, len(b.remotes))
+	for namespace := range b.remotes {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// split separates a reader name into namespace and the remote's reader
+// name, ok is false if the namespace is unknown.
+func (b *RemoteBackend) split(reader string) (namespace, remoteReader string, ok bool) {
+	if i := strings.Index(reader, REMOTE_SEPARATOR); i != -1 {
+		namespace, remoteReader = reader[:i], reader[i+len(REMOTE_SEPARATOR):]
+		_, ok = b.remotes[namespace]
+	}
+	return
+}
+
+// call posts req to the remote and decodes the reply into resp, error
+// replies are returned as the scard.Error of their code, like the other
+// backends do.
+func (b *RemoteBackend) call(namespace string, req interface{}, resp interface{}) (err error) {
+	url := b.remotes[namespace]
+	var body []byte
+	if body, err = json.Marshal(req); err != nil {
+		return
+	}
+	client := *b.Client
+	client.Jar = b.jars[namespace]
+	var httpResp *http.Response
+	if httpResp, err = client.Post(url, "application/json", bytes.NewReader(body)); err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+	if body, err = ioutil.ReadAll(httpResp.Body); err != nil {
+		return
+	}
+
+	status := ScardResponse{}
+	if err = json.Unmarshal(body, &status); err != nil {
+		return fmt.Errorf("%s: %s (HTTP %d)", namespace, err.Error(), httpResp.StatusCode)
+	}
+	if status.Error != nil {
+		return status.Error.Scard()
+	}
+	if resp != nil {
+		err = json.Unmarshal(body, resp)
+	}
+	return
+}
+
+// Version returns the versions of all remotes.
+func (b *RemoteBackend) Version() string {
+	versions := []string{}
+	for _, namespace := range b.namespaces() {
+		req := ScardRequest{"version"}
+		resp := ScardVersionResponse{}
+		if err := b.call(namespace, &req, &resp); err != nil {
+			resp.Version = err.Error()
+		}
+		versions = append(versions, namespace+REMOTE_SEPARATOR+resp.Version)
+	}
+	return strings.Join(versions, " ")
+}
+
+// EstablishContext establishes a context on every remote, remotes that
+// fail are left out. It only fails if no remote could be reached.
+func (b *RemoteBackend) EstablishContext() (BackendContext, error) {
+	ctx := &remoteContext{backend: b, tokens: make(map[string]Context), cancelled: make(chan bool)}
+	var err error
+	for _, namespace := range b.namespaces() {
+		req := ScardRequest{"establishContext"}
+		resp := ScardContextResponse{}
+		if err = b.call(namespace, &req, &resp); err != nil {
+			continue
+		}
+		ctx.tokens[namespace] = resp.Ctx
+	}
+	if len(ctx.tokens) == 0 {
+		if err == nil {
+			err = scard.E_NO_SERVICE
+		}
+		return nil, err
+	}
+	return ctx, nil
+}
+
+type remoteContext struct {
+	backend *RemoteBackend
+	// guards tokens, remotes found invalid are dropped.
+	lock sync.Mutex
+	// namespace -> context token on the remote
+	tokens map[string]Context
+	// closed to cancel waits not involving any remote.
+	cancelled chan bool
+}
+
+func (ctx *remoteContext) namespaces() []string {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	namespaces := make([]string, 0, len(ctx.tokens))
+	for namespace := range ctx.tokens {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// token returns the context token on the remote, empty if there's none.
+func (ctx *remoteContext) token(namespace string) Context {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.tokens[namespace]
+}
+
+// cancelWaits cancels waits not involving any remote.
+func (ctx *remoteContext) cancelWaits() {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	close(ctx.cancelled)
+	ctx.cancelled = make(chan bool)
+}
+
+// wait waits for timeout (forever if negative) unless cancelled.
+func (ctx *remoteContext) wait(timeout time.Duration) error {
+	var deadline <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ctx.lock.Lock()
+	cancelled := ctx.cancelled
+	ctx.lock.Unlock()
+	select {
+	case <-deadline:
+		return scard.E_TIMEOUT
+	case <-cancelled:
+		return scard.E_CANCELLED
+	}
+}
+
+// drop leaves the remote out from now on.
+func (ctx *remoteContext) drop(namespace string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	delete(ctx.tokens, namespace)
+}
+
+// each calls method on the context of every remote and returns the first
+// error.
+func (ctx *remoteContext) each(method string) (err error) {
+	for _, namespace := range ctx.namespaces() {
+		req := ScardCtxRequest{ScardRequest{method}, ctx.token(namespace)}
+		if err2 := ctx.backend.call(namespace, &req, nil); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return
+}
+
+func (ctx *remoteContext) Release() error {
+	ctx.cancelWaits()
+	return ctx.each("releaseContext")
+}
+
+// IsValid reports whether the context is valid on any remote, remotes
+// where it isn't (e.g. unreachable or reaped) are dropped like those
+// EstablishContext fails on.
+func (ctx *remoteContext) IsValid() (valid bool, err error) {
+	for _, namespace := range ctx.namespaces() {
+		req := ScardCtxRequest{ScardRequest{"isValid"}, ctx.token(namespace)}
+		if err2 := ctx.backend.call(namespace, &req, nil); err2 == nil {
+			valid = true
+			continue
+		} else if err2 != scard.E_INVALID_HANDLE && err == nil {
+			err = err2
+		}
+		ctx.drop(namespace)
+	}
+	if valid {
+		return true, nil
+	}
+	return false, err
+}
+
+func (ctx *remoteContext) Cancel() error {
+	ctx.cancelWaits()
+	return ctx.each("cancel")
+}
+
+// ListReaders returns the readers of all reachable remotes prefixed with
+// their namespace.
+func (ctx *remoteContext) ListReaders() (readers []string, err error) {
+	for _, namespace := range ctx.namespaces() {
+		req := ScardListReadersRequest{}
+		req.Method = "listReaders"
+		req.Ctx = ctx.token(namespace)
+		resp := ScardListReadersResponse{}
+		if err2 := ctx.backend.call(namespace, &req, &resp); err2 != nil {
+			continue
+		}
+		for _, reader := range resp.Readers {
+			readers = append(readers, namespace+REMOTE_SEPARATOR+reader)
+		}
+	}
+	if len(readers) == 0 {
+		return nil, scard.E_NO_READERS_AVAILABLE
+	}
+	return
+}
+
+func (ctx *remoteContext) ListReaderGroups() (groups []string, err error) {
+	for _, namespace := range ctx.namespaces() {
+		req := ScardCtxRequest{ScardRequest{"listReaderGroups"}, ctx.token(namespace)}
+		resp := ScardListReaderGroupsResponse{}
+		if err = ctx.backend.call(namespace, &req, &resp); err != nil {
+			return nil, err
+		}
+		for _, group := range resp.Groups {
+			if !contains(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return
+}
+
+type remoteStatusChange struct {
+	namespace string
+	resp      ScardGetStatusChangeResponse
+	err       error
+}
+
+// GetStatusChange waits on all remotes involved in parallel, as soon as
+// one of them reports a change (or an error) the others are cancelled.
+// Readers of unknown remotes are reported as STATE_UNKNOWN, waiting for
+// PNP_NOTIFICATION isn't supported. Without any reader of a remote it
+// just waits for timeout.
+func (ctx *remoteContext) GetStatusChange(readerStates []scard.ReaderState, timeout time.Duration) error {
+	ms := int64(timeout / time.Millisecond)
+	if timeout < 0 {
+		ms = -1
+	}
+
+	changed := false
+	requests := make(map[string]*ScardGetStatusChangeRequest)
+	indices := make(map[string][]int)
+	for i := range readerStates {
+		rs := &readerStates[i]
+		namespace, reader, ok := ctx.backend.split(rs.Reader)
+		if !ok || ctx.token(namespace) == "" {
+			rs.EventState = scard.STATE_UNKNOWN
+			if rs.CurrentState&^scard.STATE_CHANGED != scard.STATE_UNKNOWN {
+				rs.EventState |= scard.STATE_CHANGED
+				// report the state of the others without waiting.
+				changed, ms = true, 0
+			}
+			continue
+		}
+		if requests[namespace] == nil {
+			req := &ScardGetStatusChangeRequest{}
+			req.Method = "getStatusChange"
+			req.Ctx = ctx.token(namespace)
+			requests[namespace] = req
+		}
+		requests[namespace].ReaderStates = append(requests[namespace].ReaderStates, ReaderState{
+			Reader:       reader,
+			CurrentState: uint32(rs.CurrentState),
+			ATR:          hex.EncodeToString(rs.Atr),
+		})
+		indices[namespace] = append(indices[namespace], i)
+	}
+	if len(requests) == 0 {
+		if changed {
+			return nil
+		}
+		return ctx.wait(timeout)
+	}
+
+	results := make(chan remoteStatusChange, len(requests))
+	for namespace, req := range requests {
+		req.Timeout = ms
+		go func(namespace string, req *ScardGetStatusChangeRequest) {
+			result := remoteStatusChange{namespace: namespace}
+			result.err = ctx.backend.call(namespace, req, &result.resp)
+			results <- result
+		}(namespace, req)
+	}
+
+	var err error
+	var cancel <-chan time.Time
+	pending := make(map[string]bool)
+	for namespace := range requests {
+		pending[namespace] = true
+	}
+	for first := true; len(pending) != 0; {
+		select {
+		case result := <-results:
+			delete(pending, result.namespace)
+			if first {
+				err = result.err
+				first = false
+				// the cancel may reach a remote before its
+				// request, so keep cancelling until all returned.
+				ticker := time.NewTicker(100 * time.Millisecond)
+				defer ticker.Stop()
+				cancel = ticker.C
+				ctx.cancel(pending)
+			}
+			for i, index := range indices[result.namespace] {
+				rs := &readerStates[index]
+				if result.err != nil || i >= len(result.resp.ReaderStates) {
+					rs.EventState = rs.CurrentState
+					continue
+				}
+				rs.EventState = scard.StateFlag(result.resp.ReaderStates[i].EventState)
+				rs.Atr, _ = hex.DecodeString(result.resp.ReaderStates[i].ATR)
+			}
+		case <-cancel:
+			ctx.cancel(pending)
+		}
+	}
+	return err
+}
+
+func (ctx *remoteContext) cancel(namespaces map[string]bool) {
+	for namespace := range namespaces {
+		req := ScardCtxRequest{ScardRequest{"cancel"}, ctx.token(namespace)}
+		ctx.backend.call(namespace, &req, nil)
+	}
+}
+
+func (ctx *remoteContext) Connect(reader string, mode scard.ShareMode, proto scard.Protocol) (BackendCard, error) {
+	namespace, remoteReader, ok := ctx.backend.split(reader)
+	if !ok || ctx.token(namespace) == "" {
+		return nil, scard.E_UNKNOWN_READER
+	}
+	req := ScardConnectRequest{}
+	req.Method = "connect"
+	req.Ctx = ctx.token(namespace)
+	req.Reader = remoteReader
+	req.ShareMode = ShareModeFromScard(mode)
+	req.Protocol = ProtocolFromScard(proto)
+	resp := ScardConnectResponse{}
+	if err := ctx.backend.call(namespace, &req, &resp); err != nil {
+		return nil, err
+	}
+	return &remoteCard{ctx: ctx, namespace: namespace, token: resp.Card}, nil
+}
+
+type remoteCard struct {
+	ctx       *remoteContext
+	namespace string
+	token     Card
+}
+
+func (c *remoteCard) call(req interface{}, resp interface{}) error {
+	return c.ctx.backend.call(c.namespace, req, resp)
+}
+
+func (c *remoteCard) remoteCtx() Context {
+	return c.ctx.token(c.namespace)
+}
+
+func (c *remoteCard) Disconnect(d scard.Disposition) error {
+	req := ScardDisconnectRequest{}
+	req.Method = "disconnect"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.Disposition = DispositionFromScard(d)
+	return c.call(&req, nil)
+}
+
+func (c *remoteCard) Reconnect(mode scard.ShareMode, proto scard.Protocol, d scard.Disposition) error {
+	req := ScardReconnectRequest{}
+	req.Method = "reconnect"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.ShareMode = ShareModeFromScard(mode)
+	req.Protocol = ProtocolFromScard(proto)
+	req.Disposition = DispositionFromScard(d)
+	return c.call(&req, nil)
+}
+
+// BeginTransaction ends the transaction with LEAVE_CARD should the
+// remote reap the card, the front server takes care of the disposition
+// the client asked for.
+func (c *remoteCard) BeginTransaction() error {
+	req := ScardBeginTransactionRequest{}
+	req.Method = "beginTransaction"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.Disposition = LEAVE_CARD
+	return c.call(&req, nil)
+}
+
+func (c *remoteCard) EndTransaction(d scard.Disposition) error {
+	req := ScardEndTransactionRequest{}
+	req.Method = "endTransaction"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.Disposition = DispositionFromScard(d)
+	return c.call(&req, nil)
+}
+
+func (c *remoteCard) Status() (*scard.CardStatus, error) {
+	req := ScardStatusRequest{}
+	req.Method = "status"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	resp := ScardStatusResponse{}
+	if err := c.call(&req, &resp); err != nil {
+		return nil, err
+	}
+	atr, err := hex.DecodeString(resp.ATR)
+	if err != nil {
+		return nil, err
+	}
+	return &scard.CardStatus{
+		Reader:         c.namespace + REMOTE_SEPARATOR + resp.Reader,
+		State:          scard.State(resp.State),
+		ActiveProtocol: resp.ActiveProtocol.Scard(),
+		ATR:            atr,
+	}, nil
+}
+
+func (c *remoteCard) Transmit(cmd []byte) ([]byte, error) {
+	req := ScardTransmitRequest{}
+	req.Method = "transmit"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.Data = hex.EncodeToString(cmd)
+	resp := ScardTransmitResponse{}
+	if err := c.call(&req, &resp); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(resp.Data)
+}
+
+func (c *remoteCard) Control(code uint32, in []byte) ([]byte, error) {
+	req := ScardControlRequest{}
+	req.Method = "control"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.ControlCode = code
+	req.Data = hex.EncodeToString(in)
+	resp := ScardControlResponse{}
+	if err := c.call(&req, &resp); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(resp.Data)
+}
+
+func (c *remoteCard) GetAttrib(id scard.Attrib) ([]byte, error) {
+	req := ScardGetAttribRequest{}
+	req.Method = "getAttrib"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.AttrId = Attrib(id)
+	resp := ScardGetAttribResponse{}
+	if err := c.call(&req, &resp); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(resp.Data)
+}
+
+func (c *remoteCard) SetAttrib(id scard.Attrib, data []byte) error {
+	req := ScardSetAttribRequest{}
+	req.Method = "setAttrib"
+	req.Ctx, req.Card = c.remoteCtx(), c.token
+	req.AttrId = Attrib(id)
+	req.Data = hex.EncodeToString(data)
+	return c.call(&req, nil)
+}
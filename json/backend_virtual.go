@@ -0,0 +1,572 @@
+package json
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// VirtualBackend is an in-process PC/SC implementation with virtual
+// readers and cards, it lets the JSON layer be exercised without pcscd or
+// hardware:
+//
+//	b := NewVirtualBackend()
+//	rdr := b.AddReader("Virtual Reader 0")
+//	rdr.Insert(NewVirtualCard(atr, Script(map[string]string{
+//		"00A4040007A0000000041010": "6F..9000",
+//	})))
+//	SetBackend(b)
+//
+// Cards can be inserted and removed at any time, blocked getStatusChange
+// calls see the change like they would with a real reader.
+type VirtualBackend struct {
+	lock    sync.Mutex
+	readers []*VirtualReader
+	// closed and replaced whenever the state of a reader changes.
+	changed chan bool
+}
+
+const VIRTUAL_VERSION = "virtual"
+
+// the special reader name used to wait for readers being added or
+// removed, the reader count is reported in the upper 16 bits of the event
+// state.
+const PNP_NOTIFICATION = `\\?PnP?\Notification`
+
+// card states reported by Status (SCARD_PRESENT | SCARD_POWERED |
+// SCARD_SPECIFIC)
+const virtualCardState scard.State = 0x0004 | 0x0010 | 0x0040
+
+func NewVirtualBackend() *VirtualBackend {
+	return &VirtualBackend{changed: make(chan bool)}
+}
+
+// notify wakes up everyone waiting for a change, b.lock must be held.
+func (b *VirtualBackend) notify() {
+	close(b.changed)
+	b.changed = make(chan bool)
+}
+
+// AddReader plugs in an empty reader.
+func (b *VirtualBackend) AddReader(name string) *VirtualReader {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	r := &VirtualReader{
+		Name:    name,
+		backend: b,
+		conns:   make(map[*virtualConn]bool),
+		attribs: map[scard.Attrib][]byte{
+			scard.Attrib(ATTR_VENDOR_NAME):          []byte("Virtual\x00"),
+			scard.Attrib(ATTR_DEVICE_FRIENDLY_NAME): []byte(name + "\x00"),
+		},
+	}
+	b.readers = append(b.readers, r)
+	b.notify()
+	return r
+}
+
+// RemoveReader unplugs the named reader, handles connected to it report
+// READER_UNAVAILABLE from now on.
+func (b *VirtualBackend) RemoveReader(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, r := range b.readers {
+		if r.Name == name {
+			r.removed = true
+			b.readers = append(b.readers[:i], b.readers[i+1:]...)
+			b.notify()
+			return
+		}
+	}
+}
+
+// reader returns the named reader or nil, b.lock must be held.
+func (b *VirtualBackend) reader(name string) *VirtualReader {
+	for _, r := range b.readers {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// readerState returns the event state and ATR of the named reader as
+// reported by GetStatusChange, b.lock must be held.
+func (b *VirtualBackend) readerState(name string) (scard.StateFlag, []byte) {
+	if name == PNP_NOTIFICATION {
+		return scard.StateFlag(len(b.readers) << 16), nil
+	}
+	r := b.reader(name)
+	switch {
+	case r == nil:
+		return scard.STATE_UNKNOWN, nil
+	case r.card == nil:
+		return scard.STATE_EMPTY, nil
+	}
+	state := scard.STATE_PRESENT
+	if r.exclusive() {
+		state |= scard.STATE_EXCLUSIVE
+	} else if len(r.conns) != 0 {
+		state |= scard.STATE_INUSE
+	}
+	if r.card.Mute {
+		state |= scard.STATE_MUTE
+	}
+	return state, r.card.ATR
+}
+
+func (b *VirtualBackend) Version() string {
+	return VIRTUAL_VERSION
+}
+
+func (b *VirtualBackend) EstablishContext() (BackendContext, error) {
+	return &virtualContext{
+		backend: b,
+		conns:   make(map[*virtualConn]bool),
+		cancel:  make(chan bool),
+	}, nil
+}
+
+// VirtualReader is a reader of a VirtualBackend.
+type VirtualReader struct {
+	Name    string
+	backend *VirtualBackend
+	removed bool
+
+	card        *VirtualCard
+	conns       map[*virtualConn]bool
+	transaction *virtualConn
+
+	control func(code uint32, in []byte) ([]byte, error)
+	attribs map[scard.Attrib][]byte
+}
+
+// Insert puts card into the reader, replacing any card already present.
+func (r *VirtualReader) Insert(card *VirtualCard) {
+	r.backend.lock.Lock()
+	defer r.backend.lock.Unlock()
+	r.card = card
+	r.transaction = nil
+	r.backend.notify()
+}
+
+// Remove takes the card out of the reader, handles connected to it report
+// REMOVED_CARD from now on.
+func (r *VirtualReader) Remove() {
+	r.backend.lock.Lock()
+	defer r.backend.lock.Unlock()
+	r.card = nil
+	r.transaction = nil
+	r.backend.notify()
+}
+
+// SetControl installs the function answering SCardControl for this
+// reader, without one control returns UNSUPPORTED_FEATURE.
+func (r *VirtualReader) SetControl(f func(code uint32, in []byte) ([]byte, error)) {
+	r.backend.lock.Lock()
+	defer r.backend.lock.Unlock()
+	r.control = f
+}
+
+// exclusive reports whether someone is connected in EXCLUSIVE mode,
+// r.backend.lock must be held.
+func (r *VirtualReader) exclusive() bool {
+	for conn := range r.conns {
+		if conn.mode == scard.SHARE_EXCLUSIVE {
+			return true
+		}
+	}
+	return false
+}
+
+// APDUHandler answers a command APDU with a response APDU (including
+// SW1 SW2). Returning an error simulates a communication failure, it
+// should be a scard.Error such as scard.W_UNRESPONSIVE_CARD.
+type APDUHandler func(cmd []byte) (resp []byte, err error)
+
+// VirtualCard is a card that can be inserted into a VirtualReader.
+type VirtualCard struct {
+	ATR []byte
+	// PROTOCOL_T0 or PROTOCOL_T1 (default)
+	Protocol scard.Protocol
+	Handler  APDUHandler
+	// a mute card is present but doesn't answer.
+	Mute bool
+}
+
+func NewVirtualCard(atr []byte, handler APDUHandler) *VirtualCard {
+	return &VirtualCard{ATR: atr, Protocol: scard.PROTOCOL_T1, Handler: handler}
+}
+
+// Script returns an APDUHandler answering from a table mapping hex
+// encoded commands to hex encoded responses, spaces and case don't
+// matter. Commands not in the table are answered with 6D00 (INS not
+// supported). Script panics if the table isn't valid hex.
+func Script(table map[string]string) APDUHandler {
+	normalize := func(s string) string {
+		return strings.ToUpper(strings.Replace(s, " ", "", -1))
+	}
+	responses := make(map[string][]byte, len(table))
+	for cmd, resp := range table {
+		data, err := hex.DecodeString(normalize(resp))
+		if err != nil {
+			panic("invalid response for " + cmd + ": " + err.Error())
+		}
+		responses[normalize(cmd)] = data
+	}
+	return func(cmd []byte) ([]byte, error) {
+		if resp, ok := responses[strings.ToUpper(hex.EncodeToString(cmd))]; ok {
+			return resp, nil
+		}
+		return []byte{0x6D, 0x00}, nil
+	}
+}
+
+type virtualContext struct {
+	backend  *VirtualBackend
+	released bool
+	conns    map[*virtualConn]bool
+	// closed by Cancel to wake up GetStatusChange
+	cancel chan bool
+}
+
+func (ctx *virtualContext) Release() error {
+	b := ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ctx.released {
+		return scard.E_INVALID_HANDLE
+	}
+	ctx.released = true
+	for conn := range ctx.conns {
+		conn.disconnect()
+	}
+	close(ctx.cancel)
+	b.notify()
+	return nil
+}
+
+func (ctx *virtualContext) IsValid() (bool, error) {
+	ctx.backend.lock.Lock()
+	defer ctx.backend.lock.Unlock()
+	return !ctx.released, nil
+}
+
+func (ctx *virtualContext) Cancel() error {
+	ctx.backend.lock.Lock()
+	defer ctx.backend.lock.Unlock()
+
+	if ctx.released {
+		return scard.E_INVALID_HANDLE
+	}
+	close(ctx.cancel)
+	ctx.cancel = make(chan bool)
+	return nil
+}
+
+func (ctx *virtualContext) ListReaders() ([]string, error) {
+	b := ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ctx.released {
+		return nil, scard.E_INVALID_HANDLE
+	}
+	if len(b.readers) == 0 {
+		return nil, scard.E_NO_READERS_AVAILABLE
+	}
+	readers := make([]string, len(b.readers))
+	for i, r := range b.readers {
+		readers[i] = r.Name
+	}
+	return readers, nil
+}
+
+func (ctx *virtualContext) ListReaderGroups() ([]string, error) {
+	ctx.backend.lock.Lock()
+	defer ctx.backend.lock.Unlock()
+
+	if ctx.released {
+		return nil, scard.E_INVALID_HANDLE
+	}
+	return []string{"SCard$DefaultReaders"}, nil
+}
+
+func (ctx *virtualContext) GetStatusChange(readerStates []scard.ReaderState, timeout time.Duration) error {
+	var deadline <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	b := ctx.backend
+	for {
+		b.lock.Lock()
+		if ctx.released {
+			b.lock.Unlock()
+			return scard.E_INVALID_HANDLE
+		}
+		changed := false
+		for i := range readerStates {
+			rs := &readerStates[i]
+			if rs.CurrentState&scard.STATE_IGNORE != 0 {
+				continue
+			}
+			rs.EventState, rs.Atr = b.readerState(rs.Reader)
+			if rs.EventState != rs.CurrentState&^scard.STATE_CHANGED {
+				rs.EventState |= scard.STATE_CHANGED
+				changed = true
+			}
+		}
+		wait, cancel := b.changed, ctx.cancel
+		b.lock.Unlock()
+
+		if changed {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-cancel:
+			return scard.E_CANCELLED
+		case <-deadline:
+			return scard.E_TIMEOUT
+		}
+	}
+}
+
+func (ctx *virtualContext) Connect(reader string, mode scard.ShareMode, proto scard.Protocol) (BackendCard, error) {
+	b := ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ctx.released {
+		return nil, scard.E_INVALID_HANDLE
+	}
+	r := b.reader(reader)
+	if r == nil {
+		return nil, scard.E_UNKNOWN_READER
+	}
+	if r.exclusive() || (mode == scard.SHARE_EXCLUSIVE && len(r.conns) != 0) {
+		return nil, scard.E_SHARING_VIOLATION
+	}
+
+	conn := &virtualConn{ctx: ctx, reader: r, card: r.card, mode: mode}
+	// DIRECT connections don't need a card.
+	if mode != scard.SHARE_DIRECT || proto != scard.PROTOCOL_UNDEFINED {
+		if r.card == nil {
+			return nil, scard.E_NO_SMARTCARD
+		}
+		if proto&r.card.Protocol == 0 {
+			return nil, scard.E_PROTO_MISMATCH
+		}
+		conn.proto = r.card.Protocol
+	}
+	r.conns[conn] = true
+	ctx.conns[conn] = true
+	b.notify()
+	return conn, nil
+}
+
+// virtualConn is a connection to a VirtualReader, all fields are guarded
+// by the backend lock.
+type virtualConn struct {
+	ctx          *virtualContext
+	reader       *VirtualReader
+	card         *VirtualCard // the card present when connecting
+	mode         scard.ShareMode
+	proto        scard.Protocol
+	disconnected bool
+}
+
+// check returns the error PC/SC would report for using the connection,
+// the backend lock must be held.
+func (c *virtualConn) check() error {
+	switch {
+	case c.disconnected:
+		return scard.E_INVALID_HANDLE
+	case c.reader.removed:
+		return scard.E_READER_UNAVAILABLE
+	case c.reader.card != c.card:
+		return scard.W_REMOVED_CARD
+	}
+	return nil
+}
+
+// disconnect drops the connection, the backend lock must be held.
+func (c *virtualConn) disconnect() {
+	c.disconnected = true
+	delete(c.reader.conns, c)
+	delete(c.ctx.conns, c)
+	if c.reader.transaction == c {
+		c.reader.transaction = nil
+	}
+}
+
+func (c *virtualConn) Disconnect(d scard.Disposition) error {
+	b := c.ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c.disconnected {
+		return scard.E_INVALID_HANDLE
+	}
+	c.disconnect()
+	b.notify()
+	return nil
+}
+
+func (c *virtualConn) Reconnect(mode scard.ShareMode, proto scard.Protocol, d scard.Disposition) error {
+	b := c.ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := c.check(); err != nil {
+		return err
+	}
+	if mode == scard.SHARE_EXCLUSIVE && len(c.reader.conns) != 1 {
+		return scard.E_SHARING_VIOLATION
+	}
+	if c.card != nil {
+		if proto&c.card.Protocol == 0 {
+			return scard.E_PROTO_MISMATCH
+		}
+		c.proto = c.card.Protocol
+	}
+	c.mode = mode
+	b.notify()
+	return nil
+}
+
+// BeginTransaction blocks while another connection holds a transaction
+// on the reader.
+func (c *virtualConn) BeginTransaction() error {
+	b := c.ctx.backend
+	for {
+		b.lock.Lock()
+		if err := c.check(); err != nil {
+			b.lock.Unlock()
+			return err
+		}
+		if c.reader.transaction == nil || c.reader.transaction == c {
+			c.reader.transaction = c
+			b.lock.Unlock()
+			return nil
+		}
+		wait := b.changed
+		b.lock.Unlock()
+		<-wait
+	}
+}
+
+func (c *virtualConn) EndTransaction(d scard.Disposition) error {
+	b := c.ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := c.check(); err != nil {
+		return err
+	}
+	if c.reader.transaction != c {
+		return scard.E_NOT_TRANSACTED
+	}
+	c.reader.transaction = nil
+	b.notify()
+	return nil
+}
+
+func (c *virtualConn) Status() (*scard.CardStatus, error) {
+	b := c.ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	if c.card == nil {
+		return nil, scard.E_NO_SMARTCARD
+	}
+	return &scard.CardStatus{
+		Reader:         c.reader.Name,
+		State:          virtualCardState,
+		ActiveProtocol: c.proto,
+		ATR:            append([]byte{}, c.card.ATR...),
+	}, nil
+}
+
+func (c *virtualConn) Transmit(cmd []byte) ([]byte, error) {
+	b := c.ctx.backend
+	b.lock.Lock()
+	if err := c.check(); err != nil {
+		b.lock.Unlock()
+		return nil, err
+	}
+	card := c.card
+	busy := c.reader.transaction != nil && c.reader.transaction != c
+	b.lock.Unlock()
+
+	switch {
+	case card == nil:
+		return nil, scard.E_NO_SMARTCARD
+	case busy:
+		return nil, scard.E_SHARING_VIOLATION
+	case card.Mute:
+		return nil, scard.W_UNRESPONSIVE_CARD
+	case card.Handler == nil:
+		return []byte{0x6D, 0x00}, nil
+	}
+	// the handler is called without holding the lock so it may insert or
+	// remove cards.
+	return card.Handler(cmd)
+}
+
+func (c *virtualConn) Control(code uint32, in []byte) ([]byte, error) {
+	b := c.ctx.backend
+	b.lock.Lock()
+	if c.disconnected {
+		b.lock.Unlock()
+		return nil, scard.E_INVALID_HANDLE
+	}
+	control := c.reader.control
+	b.lock.Unlock()
+
+	if control == nil {
+		return nil, scard.E_UNSUPPORTED_FEATURE
+	}
+	return control(code, in)
+}
+
+func (c *virtualConn) GetAttrib(id scard.Attrib) ([]byte, error) {
+	b := c.ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c.disconnected {
+		return nil, scard.E_INVALID_HANDLE
+	}
+	if id == scard.Attrib(ATTR_ATR_STRING) && c.card != nil {
+		return append([]byte{}, c.card.ATR...), nil
+	}
+	if data, ok := c.reader.attribs[id]; ok {
+		return append([]byte{}, data...), nil
+	}
+	return nil, scard.E_UNSUPPORTED_FEATURE
+}
+
+func (c *virtualConn) SetAttrib(id scard.Attrib, data []byte) error {
+	b := c.ctx.backend
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c.disconnected {
+		return scard.E_INVALID_HANDLE
+	}
+	c.reader.attribs[id] = append([]byte{}, data...)
+	return nil
+}
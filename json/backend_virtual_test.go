@@ -0,0 +1,141 @@
+package json
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+func virtualCall(t *testing.T, req string, resp interface{}) {
+	writer := &bytes.Buffer{}
+	if err := ScardJson(strings.NewReader(req), writer); err != nil {
+		t.Fatal(err)
+	} else if err = decodeFully(writer, resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVirtualInsertRemove(t *testing.T) {
+	rdr := virtual.AddReader("Virtual Reader Insert")
+	defer virtual.RemoveReader(rdr.Name)
+
+	var ctx Context
+	var err error
+	if ctx, err = getContext(); err != nil {
+		t.Fatal(err)
+	}
+	defer releaseContext(ctx, LEAVE_CARD)
+
+	wait := func(current scard.StateFlag) ScardGetStatusChangeResponse {
+		resp := ScardGetStatusChangeResponse{}
+		req := `{"method":"getStatusChange", "ctx":"%s", "timeout":5000, "readerStates":[{"reader":"%s", "currentState":%d}]}`
+		virtualCall(t, fmt.Sprintf(req, ctx, rdr.Name, current), &resp)
+		if resp.Error != nil {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+		return resp
+	}
+
+	if resp := wait(scard.STATE_UNAWARE); scard.StateFlag(resp.ReaderStates[0].EventState)&scard.STATE_EMPTY == 0 {
+		t.Fatalf("reader not empty: %x", resp.ReaderStates[0].EventState)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rdr.Insert(newTestCard())
+	}()
+	resp := wait(scard.STATE_EMPTY)
+	if scard.StateFlag(resp.ReaderStates[0].EventState)&scard.STATE_PRESENT == 0 {
+		t.Fatalf("card not present: %x", resp.ReaderStates[0].EventState)
+	}
+	if resp.ReaderStates[0].ATR != fmt.Sprintf("%x", testATR) {
+		t.Errorf("unexpected ATR: %s", resp.ReaderStates[0].ATR)
+	}
+
+	connect := ScardConnectResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, rdr.Name), &connect)
+	if connect.Error != nil {
+		t.Fatalf("connect: %s", connect.Error)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rdr.Remove()
+	}()
+	resp = wait(scard.STATE_PRESENT | scard.STATE_INUSE)
+	if scard.StateFlag(resp.ReaderStates[0].EventState)&scard.STATE_EMPTY == 0 {
+		t.Fatalf("card not removed: %x", resp.ReaderStates[0].EventState)
+	}
+
+	transmit := ScardTransmitResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"transmit", "ctx":"%s", "card":"%s", "data":"00A40000023F00"}`, ctx, connect.Card), &transmit)
+	if !transmit.Error.HasCode(scard.W_REMOVED_CARD) {
+		t.Errorf("unexpected error: %s", transmit.Error)
+	}
+}
+
+func TestVirtualReaderNotification(t *testing.T) {
+	var ctx Context
+	var err error
+	if ctx, err = getContext(); err != nil {
+		t.Fatal(err)
+	}
+	defer releaseContext(ctx, LEAVE_CARD)
+
+	states := []scard.ReaderState{{Reader: PNP_NOTIFICATION}}
+	if err = contextFor(ctx).GetStatusChange(states, 0); err != nil {
+		t.Fatal(err)
+	}
+	states[0].CurrentState = states[0].EventState &^ scard.STATE_CHANGED
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		virtual.AddReader("Virtual Reader PnP")
+	}()
+	defer virtual.RemoveReader("Virtual Reader PnP")
+
+	if err = contextFor(ctx).GetStatusChange(states, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if before, after := states[0].CurrentState>>16, states[0].EventState>>16; after != before+1 {
+		t.Errorf("expected %d readers, got %d", before+1, after)
+	}
+}
+
+func TestVirtualSharingViolation(t *testing.T) {
+	var ctx Context
+	var err error
+	if ctx, err = getContext(); err != nil {
+		t.Fatal(err)
+	}
+	defer releaseContext(ctx, LEAVE_CARD)
+
+	req := `{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"%s", "protocol":"ANY"}`
+
+	exclusive := ScardConnectResponse{}
+	virtualCall(t, fmt.Sprintf(req, ctx, virtualReader.Name, "EXCLUSIVE"), &exclusive)
+	if exclusive.Error != nil {
+		t.Fatalf("connect: %s", exclusive.Error)
+	}
+	shared := ScardConnectResponse{}
+	virtualCall(t, fmt.Sprintf(req, ctx, virtualReader.Name, "SHARED"), &shared)
+	if !shared.Error.HasCode(scard.E_SHARING_VIOLATION) {
+		t.Errorf("unexpected error: %s", shared.Error)
+	}
+}
+
+func TestScript(t *testing.T) {
+	handler := Script(map[string]string{
+		"00 a4 00 00 02 3f 00": "90 00",
+	})
+	if resp, _ := handler([]byte{0x00, 0xA4, 0x00, 0x00, 0x02, 0x3F, 0x00}); !bytes.Equal(resp, []byte{0x90, 0x00}) {
+		t.Errorf("unexpected response: %x", resp)
+	}
+	if resp, _ := handler([]byte{0x00, 0xB0, 0x00, 0x00, 0x00}); !bytes.Equal(resp, []byte{0x6D, 0x00}) {
+		t.Errorf("unexpected response: %x", resp)
+	}
+}
@@ -0,0 +1,105 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// Several requests can be sent at once, either as a plain JSON array of
+// (flat or JSON-RPC) requests answered by an array of responses:
+//
+//	[{"method":"transmit", ..}, {"method":"transmit", ..}]
+//
+// or using the "batch" method, which additionally allows stopping at the
+// first failing request and running the requests inside a transaction on
+// a card:
+//
+//	{"method":"batch", "stopOnError":true, "transaction":true,
+//	 "ctx":"ctx_..", "card":"card_..", "requests":[..]}
+//
+// The responses are returned in "responses", with stopOnError the
+// response of the failed request is the last one. If the transaction
+// can't be ended afterwards, the responses are returned nonetheless and
+// the failure is reported in "transactionError".
+
+var (
+	errEmptyBatch   = errParse(errors.New("empty batch"))
+	errBatchElement = errParse(errors.New("batch element is not a request object"))
+)
+
+// isBatch reports whether req is a JSON array.
+func isBatch(req json.RawMessage) bool {
+	req = bytes.TrimSpace(req)
+	return len(req) != 0 && req[0] == '['
+}
+
+// failed reports whether resp is an error response.
+func failed(resp interface{}) bool {
+	if resp, ok := resp.(*JsonRpcResponse); ok {
+		return resp.Error != nil
+	}
+	return ResponseError(resp) != nil
+}
+
+// runBatch runs reqs in order and returns their responses, JSON-RPC
+// notifications have none. Elements which aren't objects are answered
+// with a JSON-RPC error, they can't tell which kind of request they are.
+func runBatch(s *Session, reqs []json.RawMessage, stopOnError bool) []interface{} {
+	responses := make([]interface{}, 0, len(reqs))
+	for _, req := range reqs {
+		var resp interface{}
+		if req = bytes.TrimSpace(req); len(req) == 0 || req[0] != '{' {
+			resp = jsonrpcFailure(JSONRPC_INVALID_REQUEST, errBatchElement)
+		} else {
+			resp = handleRequest(s, req)
+		}
+		if resp != nil {
+			responses = append(responses, resp)
+		}
+		if stopOnError && failed(resp) {
+			break
+		}
+	}
+	return responses
+}
+
+// handleBatch runs the requests of the JSON array req, the response is
+// nil if there are only JSON-RPC notifications.
+func handleBatch(s *Session, req json.RawMessage) interface{} {
+	var reqs []json.RawMessage
+	if err := json.Unmarshal(req, &reqs); err != nil {
+		return errorResponse(errParse(err))
+	}
+	if len(reqs) == 0 {
+		return jsonrpcFailure(JSONRPC_INVALID_REQUEST, errEmptyBatch)
+	}
+	if responses := runBatch(s, reqs, false); len(responses) != 0 {
+		return responses
+	}
+	return nil
+}
+
+func batch(s *Session, req *ScardBatchRequest, resp *ScardBatchResponse) (err error) {
+	if len(req.Requests) == 0 {
+		return errEmptyBatch
+	}
+	if !req.Transaction {
+		resp.Responses = runBatch(s, req.Requests, req.StopOnError)
+		return nil
+	}
+
+	if req.Disposition == "" {
+		req.Disposition = LEAVE_CARD
+	}
+	begin := ScardBeginTransactionRequest{Ctx: req.Ctx, Card: req.Card, Disposition: req.Disposition}
+	if err = beginTransaction(&begin, &ScardResponse{}); err != nil {
+		return
+	}
+	resp.Responses = runBatch(s, req.Requests, req.StopOnError)
+	end := ScardEndTransactionRequest{Ctx: req.Ctx, Card: req.Card, Disposition: req.Disposition}
+	if err = endTransaction(&end, &ScardResponse{}); err != nil {
+		resp.TransactionError = ToScardError(err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+func TestBatchArray(t *testing.T) {
+	ctx, err := getContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseContext(ctx, LEAVE_CARD)
+
+	connect := ScardConnectResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, virtualReader.Name), &connect)
+	if connect.Error != nil {
+		t.Fatalf("connect: %s", connect.Error)
+	}
+
+	transmit := fmt.Sprintf(`{"method":"transmit", "ctx":"%s", "card":"%s", "data":"%%s"}`, ctx, connect.Card)
+	req := "[" + fmt.Sprintf(transmit, "00A40000023F00") + "," +
+		fmt.Sprintf(transmit, "zz") + "," +
+		`{"jsonrpc":"2.0", "id":7, "method":"version"},` +
+		`{"jsonrpc":"2.0", "method":"version"}]`
+
+	writer := &bytes.Buffer{}
+	if err = ScardJson(strings.NewReader(req), writer); err != nil {
+		t.Fatal(err)
+	}
+	var responses []map[string]interface{}
+	if err = json.Unmarshal(writer.Bytes(), &responses); err != nil {
+		t.Fatalf("%s: %s", err, writer)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses: %s", writer)
+	}
+	if responses[0]["data"] != "9000" || responses[0]["error"] != nil {
+		t.Errorf("unexpected response: %v", responses[0])
+	}
+	if responses[1]["error"] == nil {
+		t.Errorf("expected error: %v", responses[1])
+	}
+	if responses[2]["id"] != float64(7) || responses[2]["result"] == nil {
+		t.Errorf("unexpected JSON-RPC response: %v", responses[2])
+	}
+
+	resp, raw := jsonrpcCall(t, `[]`)
+	if resp.Error == nil || resp.Error.Code != JSONRPC_INVALID_REQUEST || string(resp.Id) != "null" {
+		t.Errorf("empty batch accepted: %s", raw)
+	}
+
+	writer.Reset()
+	if err = ScardJson(strings.NewReader(`[1, {"method":"version"}]`), writer); err != nil {
+		t.Fatal(err)
+	}
+	var mixed []map[string]json.RawMessage
+	if err = json.Unmarshal(writer.Bytes(), &mixed); err != nil || len(mixed) != 2 {
+		t.Fatalf("unexpected response: %s", writer)
+	}
+	if string(mixed[0]["id"]) != "null" || !strings.Contains(string(mixed[0]["error"]), fmt.Sprint(JSONRPC_INVALID_REQUEST)) {
+		t.Errorf("unexpected response to non-object: %s", writer)
+	}
+	if mixed[1]["error"] != nil {
+		t.Errorf("unexpected response: %s", writer)
+	}
+}
+
+func TestBatchMethod(t *testing.T) {
+	ctx, err := getContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseContext(ctx, LEAVE_CARD)
+
+	connect := ScardConnectResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, virtualReader.Name), &connect)
+	if connect.Error != nil {
+		t.Fatalf("connect: %s", connect.Error)
+	}
+
+	transmit := fmt.Sprintf(`{"method":"transmit", "ctx":"%s", "card":"%s", "data":"%%s"}`, ctx, connect.Card)
+	requests := fmt.Sprintf(transmit, "00A40000023F00") + "," + fmt.Sprintf(transmit, "") + "," + fmt.Sprintf(transmit, "00A40000023F00")
+
+	tests := []struct {
+		options   string
+		responses int
+	}{
+		{`"stopOnError":false`, 3},
+		{`"stopOnError":true`, 2},
+		{fmt.Sprintf(`"stopOnError":true, "transaction":true, "ctx":"%s", "card":"%s"`, ctx, connect.Card), 2},
+		{fmt.Sprintf(`"transaction":true, "ctx":"%s", "card":"%s", "disposition":"RESET_CARD"`, ctx, connect.Card), 3},
+	}
+	for _, test := range tests {
+		resp := struct {
+			ScardResponse
+			Responses []ScardTransmitResponse `json:"responses"`
+		}{}
+		virtualCall(t, fmt.Sprintf(`{"method":"batch", %s, "requests":[%s]}`, test.options, requests), &resp)
+		if resp.Error != nil {
+			t.Fatalf("%s: %s", test.options, resp.Error)
+		}
+		if len(resp.Responses) != test.responses {
+			t.Fatalf("%s: expected %d responses, got %d", test.options, test.responses, len(resp.Responses))
+		}
+		if resp.Responses[0].Data != "9000" || resp.Responses[1].Error == nil {
+			t.Errorf("%s: unexpected responses: %v", test.options, resp.Responses)
+		}
+		if lookupCard(ctx, connect.Card).transaction != nil {
+			t.Errorf("%s: transaction not ended", test.options)
+		}
+	}
+
+	resp := ScardBatchResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"batch", "transaction":true, "ctx":"%s", "card":"card_unknown", "requests":[%s]}`, ctx, requests), &resp)
+	if resp.Error == nil || resp.Responses != nil {
+		t.Errorf("batch run without transaction: %v", resp)
+	}
+}
+
+func TestBatchCardRemoved(t *testing.T) {
+	rdr := virtual.AddReader("Virtual Reader Batch")
+	defer virtual.RemoveReader(rdr.Name)
+	rdr.Insert(NewVirtualCard(testATR, func(cmd []byte) ([]byte, error) {
+		// the card is pulled while answering.
+		rdr.Remove()
+		return []byte{0x90, 0x00}, nil
+	}))
+
+	ctx, err := getContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseContext(ctx, LEAVE_CARD)
+	connect := ScardConnectResponse{}
+	virtualCall(t, fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, rdr.Name), &connect)
+	if connect.Error != nil {
+		t.Fatalf("connect: %s", connect.Error)
+	}
+
+	transmit := fmt.Sprintf(`{"method":"transmit", "ctx":"%s", "card":"%s", "data":"00A40000023F00"}`, ctx, connect.Card)
+	resp := struct {
+		ScardResponse
+		Responses        []ScardTransmitResponse `json:"responses"`
+		TransactionError *ScardError             `json:"transactionError"`
+	}{}
+	virtualCall(t, fmt.Sprintf(`{"method":"batch", "transaction":true, "ctx":"%s", "card":"%s", "requests":[%s, %s]}`, ctx, connect.Card, transmit, transmit), &resp)
+	if resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if len(resp.Responses) != 2 || resp.Responses[0].Data != "9000" || !resp.Responses[1].Error.HasCode(scard.W_REMOVED_CARD) {
+		t.Errorf("unexpected responses: %+v", resp.Responses)
+	}
+	if !resp.TransactionError.HasCode(scard.W_REMOVED_CARD) {
+		t.Errorf("unexpected transaction error: %v", resp.TransactionError)
+	}
+}
@@ -0,0 +1,191 @@
+package json
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// ErrorCategory groups error codes by what a client should do about
+// them, e.g. wait for another card after CARD_REMOVED or re-establish
+// the context after EXPIRED.
+type ErrorCategory string
+
+const (
+	CATEGORY_PARSE_ERROR        ErrorCategory = "PARSE_ERROR"
+	CATEGORY_UNKNOWN_METHOD     ErrorCategory = "UNKNOWN_METHOD"
+	CATEGORY_CLIENT_ERROR       ErrorCategory = "CLIENT_ERROR"
+	CATEGORY_EXPIRED            ErrorCategory = "EXPIRED"
+	CATEGORY_CARD_REMOVED       ErrorCategory = "CARD_REMOVED"
+	CATEGORY_CARD_RESET         ErrorCategory = "CARD_RESET"
+	CATEGORY_CARD_ERROR         ErrorCategory = "CARD_ERROR"
+	CATEGORY_READER_UNAVAILABLE ErrorCategory = "READER_UNAVAILABLE"
+	CATEGORY_SHARING_VIOLATION  ErrorCategory = "SHARING_VIOLATION"
+	CATEGORY_CANCELLED          ErrorCategory = "CANCELLED"
+	CATEGORY_TIMEOUT            ErrorCategory = "TIMEOUT"
+	CATEGORY_SERVICE_ERROR      ErrorCategory = "SERVICE_ERROR"
+	CATEGORY_INTERNAL_ERROR     ErrorCategory = "INTERNAL_ERROR"
+)
+
+// ScardError is the error object returned in the "error" field of a
+// response, e.g.:
+//
+//	{"code":2148532329, "name":"SCARD_W_REMOVED_CARD",
+//	 "message":"Card was removed.", "category":"CARD_REMOVED"}
+//
+// Code is always one of the SCARD_E_*/SCARD_W_*/SCARD_F_* values, errors
+// detected by the JSON layer itself (unknown tokens, bad parameters) use
+// the closest PC/SC code and describe the details in Message.
+type ScardError struct {
+	Code     uint32        `json:"code"`
+	Name     string        `json:"name"`
+	Message  string        `json:"message"`
+	Category ErrorCategory `json:"category"`
+}
+
+func (e *ScardError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Message)
+}
+
+// HasCode reports whether e carries the given code, it's safe to call on the
+// nil error of a successful response.
+func (e *ScardError) HasCode(code scard.Error) bool {
+	return e != nil && e.Code == uint32(code)
+}
+
+type errorInfo struct {
+	name     string
+	message  string
+	category ErrorCategory
+}
+
+// Messages are those of pcsc-lite's pcsc_stringify_error.
+// SCARD_E_UNSUPPORTED_FEATURE shares its code with SCARD_E_UNEXPECTED in
+// pcsc-lite and is reported as such.
+var errorInfos = map[scard.Error]errorInfo{
+	scard.F_INTERNAL_ERROR:          {"SCARD_F_INTERNAL_ERROR", "Internal error.", CATEGORY_INTERNAL_ERROR},
+	scard.E_CANCELLED:               {"SCARD_E_CANCELLED", "Command cancelled.", CATEGORY_CANCELLED},
+	scard.E_INVALID_HANDLE:          {"SCARD_E_INVALID_HANDLE", "Invalid handle.", CATEGORY_CLIENT_ERROR},
+	scard.E_INVALID_PARAMETER:       {"SCARD_E_INVALID_PARAMETER", "Invalid parameter given.", CATEGORY_CLIENT_ERROR},
+	scard.E_INVALID_TARGET:          {"SCARD_E_INVALID_TARGET", "Invalid target given.", CATEGORY_CLIENT_ERROR},
+	scard.E_NO_MEMORY:               {"SCARD_E_NO_MEMORY", "Not enough memory.", CATEGORY_INTERNAL_ERROR},
+	scard.F_WAITED_TOO_LONG:         {"SCARD_F_WAITED_TOO_LONG", "Waited too long.", CATEGORY_TIMEOUT},
+	scard.E_INSUFFICIENT_BUFFER:     {"SCARD_E_INSUFFICIENT_BUFFER", "Insufficient buffer.", CATEGORY_CLIENT_ERROR},
+	scard.E_UNKNOWN_READER:          {"SCARD_E_UNKNOWN_READER", "Unknown reader specified.", CATEGORY_READER_UNAVAILABLE},
+	scard.E_TIMEOUT:                 {"SCARD_E_TIMEOUT", "Command timeout.", CATEGORY_TIMEOUT},
+	scard.E_SHARING_VIOLATION:       {"SCARD_E_SHARING_VIOLATION", "Sharing violation.", CATEGORY_SHARING_VIOLATION},
+	scard.E_NO_SMARTCARD:            {"SCARD_E_NO_SMARTCARD", "No smart card inserted.", CATEGORY_CARD_REMOVED},
+	scard.E_UNKNOWN_CARD:            {"SCARD_E_UNKNOWN_CARD", "Unknown card.", CATEGORY_CARD_ERROR},
+	scard.E_CANT_DISPOSE:            {"SCARD_E_CANT_DISPOSE", "Cannot dispose handle.", CATEGORY_CLIENT_ERROR},
+	scard.E_PROTO_MISMATCH:          {"SCARD_E_PROTO_MISMATCH", "Card protocol mismatch.", CATEGORY_CARD_ERROR},
+	scard.E_NOT_READY:               {"SCARD_E_NOT_READY", "Subsystem not ready.", CATEGORY_READER_UNAVAILABLE},
+	scard.E_INVALID_VALUE:           {"SCARD_E_INVALID_VALUE", "Invalid value given.", CATEGORY_CLIENT_ERROR},
+	scard.E_SYSTEM_CANCELLED:        {"SCARD_E_SYSTEM_CANCELLED", "System cancelled.", CATEGORY_CANCELLED},
+	scard.F_COMM_ERROR:              {"SCARD_F_COMM_ERROR", "RPC transport error.", CATEGORY_SERVICE_ERROR},
+	scard.F_UNKNOWN_ERROR:           {"SCARD_F_UNKNOWN_ERROR", "Unknown error.", CATEGORY_INTERNAL_ERROR},
+	scard.E_INVALID_ATR:             {"SCARD_E_INVALID_ATR", "Invalid ATR.", CATEGORY_CLIENT_ERROR},
+	scard.E_NOT_TRANSACTED:          {"SCARD_E_NOT_TRANSACTED", "Transaction failed.", CATEGORY_CLIENT_ERROR},
+	scard.E_READER_UNAVAILABLE:      {"SCARD_E_READER_UNAVAILABLE", "Reader is unavailable.", CATEGORY_READER_UNAVAILABLE},
+	scard.P_SHUTDOWN:                {"SCARD_P_SHUTDOWN", "Operation aborted.", CATEGORY_SERVICE_ERROR},
+	scard.E_PCI_TOO_SMALL:           {"SCARD_E_PCI_TOO_SMALL", "PCI struct too small.", CATEGORY_CLIENT_ERROR},
+	scard.E_READER_UNSUPPORTED:      {"SCARD_E_READER_UNSUPPORTED", "Reader is unsupported.", CATEGORY_READER_UNAVAILABLE},
+	scard.E_DUPLICATE_READER:        {"SCARD_E_DUPLICATE_READER", "Reader already exists.", CATEGORY_READER_UNAVAILABLE},
+	scard.E_CARD_UNSUPPORTED:        {"SCARD_E_CARD_UNSUPPORTED", "Card is unsupported.", CATEGORY_CARD_ERROR},
+	scard.E_NO_SERVICE:              {"SCARD_E_NO_SERVICE", "Service not available.", CATEGORY_SERVICE_ERROR},
+	scard.E_SERVICE_STOPPED:         {"SCARD_E_SERVICE_STOPPED", "Service was stopped.", CATEGORY_SERVICE_ERROR},
+	scard.E_UNEXPECTED:              {"SCARD_E_UNEXPECTED", "Unexpected card error.", CATEGORY_INTERNAL_ERROR},
+	scard.E_ICC_INSTALLATION:        {"SCARD_E_ICC_INSTALLATION", "No primary provider can be found for the smart card.", CATEGORY_CARD_ERROR},
+	scard.E_ICC_CREATEORDER:         {"SCARD_E_ICC_CREATEORDER", "The requested order of object creation is not supported.", CATEGORY_CARD_ERROR},
+	scard.E_DIR_NOT_FOUND:           {"SCARD_E_DIR_NOT_FOUND", "The identified directory does not exist in the smart card.", CATEGORY_CARD_ERROR},
+	scard.E_FILE_NOT_FOUND:          {"SCARD_E_FILE_NOT_FOUND", "The identified file does not exist in the smart card.", CATEGORY_CARD_ERROR},
+	scard.E_NO_DIR:                  {"SCARD_E_NO_DIR", "The supplied path does not represent a smart card directory.", CATEGORY_CARD_ERROR},
+	scard.E_NO_FILE:                 {"SCARD_E_NO_FILE", "The supplied path does not represent a smart card file.", CATEGORY_CARD_ERROR},
+	scard.E_NO_ACCESS:               {"SCARD_E_NO_ACCESS", "Access is denied to this file.", CATEGORY_CARD_ERROR},
+	scard.E_WRITE_TOO_MANY:          {"SCARD_E_WRITE_TOO_MANY", "The smart card does not have enough memory to store the information.", CATEGORY_CARD_ERROR},
+	scard.E_BAD_SEEK:                {"SCARD_E_BAD_SEEK", "There was an error trying to set the smart card file object pointer.", CATEGORY_CARD_ERROR},
+	scard.E_INVALID_CHV:             {"SCARD_E_INVALID_CHV", "The supplied PIN is incorrect.", CATEGORY_CARD_ERROR},
+	scard.E_UNKNOWN_RES_MNG:         {"SCARD_E_UNKNOWN_RES_MNG", "An unrecognized error code was returned from a layered component.", CATEGORY_INTERNAL_ERROR},
+	scard.E_NO_SUCH_CERTIFICATE:     {"SCARD_E_NO_SUCH_CERTIFICATE", "The requested certificate does not exist.", CATEGORY_CARD_ERROR},
+	scard.E_CERTIFICATE_UNAVAILABLE: {"SCARD_E_CERTIFICATE_UNAVAILABLE", "The requested certificate could not be obtained.", CATEGORY_CARD_ERROR},
+	scard.E_NO_READERS_AVAILABLE:    {"SCARD_E_NO_READERS_AVAILABLE", "Cannot find a smart card reader.", CATEGORY_READER_UNAVAILABLE},
+	scard.E_COMM_DATA_LOST:          {"SCARD_E_COMM_DATA_LOST", "A communications error with the smart card has been detected.", CATEGORY_CARD_ERROR},
+	scard.E_NO_KEY_CONTAINER:        {"SCARD_E_NO_KEY_CONTAINER", "The requested key container does not exist on the smart card.", CATEGORY_CARD_ERROR},
+	scard.E_SERVER_TOO_BUSY:         {"SCARD_E_SERVER_TOO_BUSY", "The smart card resource manager is too busy to complete this operation.", CATEGORY_SERVICE_ERROR},
+	scard.W_UNSUPPORTED_CARD:        {"SCARD_W_UNSUPPORTED_CARD", "Card is not supported.", CATEGORY_CARD_ERROR},
+	scard.W_UNRESPONSIVE_CARD:       {"SCARD_W_UNRESPONSIVE_CARD", "Card is unresponsive.", CATEGORY_CARD_ERROR},
+	scard.W_UNPOWERED_CARD:          {"SCARD_W_UNPOWERED_CARD", "Card is unpowered.", CATEGORY_CARD_ERROR},
+	scard.W_RESET_CARD:              {"SCARD_W_RESET_CARD", "Card was reset.", CATEGORY_CARD_RESET},
+	scard.W_REMOVED_CARD:            {"SCARD_W_REMOVED_CARD", "Card was removed.", CATEGORY_CARD_REMOVED},
+	scard.W_SECURITY_VIOLATION:      {"SCARD_W_SECURITY_VIOLATION", "Access was denied because of a security violation.", CATEGORY_CARD_ERROR},
+	scard.W_WRONG_CHV:               {"SCARD_W_WRONG_CHV", "The card cannot be accessed because the wrong PIN was presented.", CATEGORY_CARD_ERROR},
+	scard.W_CHV_BLOCKED:             {"SCARD_W_CHV_BLOCKED", "The card cannot be accessed because the maximum number of PIN entry attempts has been reached.", CATEGORY_CARD_ERROR},
+	scard.W_EOF:                     {"SCARD_W_EOF", "The end of the smart card file has been reached.", CATEGORY_CARD_ERROR},
+	scard.W_CANCELLED_BY_USER:       {"SCARD_W_CANCELLED_BY_USER", "The user pressed \"Cancel\" on a Smart Card Selection Dialog.", CATEGORY_CANCELLED},
+	scard.W_CARD_NOT_AUTHENTICATED:  {"SCARD_W_CARD_NOT_AUTHENTICATED", "No PIN was presented to the smart card.", CATEGORY_CARD_ERROR},
+}
+
+// NewScardError returns the error object for code, message and category
+// default to those of the code if empty.
+func NewScardError(code scard.Error, category ErrorCategory, message string) *ScardError {
+	info, ok := errorInfos[code]
+	if !ok {
+		info = errorInfo{fmt.Sprintf("0x%08X", uint32(code)), "Unknown error.", CATEGORY_INTERNAL_ERROR}
+	}
+	if category == "" {
+		category = info.category
+	}
+	if message == "" {
+		message = info.message
+	}
+	return &ScardError{Code: uint32(code), Name: info.name, Message: message, Category: category}
+}
+
+// ToScardError converts err to an error object. PC/SC errors keep their
+// code, anything else (e.g. an I/O error of a backend) is reported as
+// SCARD_F_INTERNAL_ERROR with the error's text as message. Malformed hex
+// data is a client error.
+func ToScardError(err error) *ScardError {
+	switch e := err.(type) {
+	case *ScardError:
+		return e
+	case scard.Error:
+		return NewScardError(e, "", "")
+	case hex.InvalidByteError:
+		return NewScardError(scard.E_INVALID_PARAMETER, CATEGORY_CLIENT_ERROR, e.Error())
+	default:
+		if err == hex.ErrLength {
+			return NewScardError(scard.E_INVALID_PARAMETER, CATEGORY_CLIENT_ERROR, err.Error())
+		}
+		return NewScardError(scard.F_INTERNAL_ERROR, "", err.Error())
+	}
+}
+
+// Scard returns the PC/SC error carrying e's code.
+func (e *ScardError) Scard() scard.Error {
+	return scard.Error(e.Code)
+}
+
+// Errors detected by the JSON layer.
+var (
+	errUnknownCtx        = NewScardError(scard.E_INVALID_HANDLE, CATEGORY_CLIENT_ERROR, "unknown context")
+	errUnknownCard       = NewScardError(scard.E_INVALID_HANDLE, CATEGORY_CLIENT_ERROR, "unknown card")
+	errExpiredCtx        = NewScardError(scard.E_INVALID_HANDLE, CATEGORY_EXPIRED, "context expired")
+	errExpiredCard       = NewScardError(scard.E_INVALID_HANDLE, CATEGORY_EXPIRED, "card expired")
+	errIncorrectParam    = NewScardError(scard.E_INVALID_PARAMETER, CATEGORY_CLIENT_ERROR, "incorrect parameter")
+	errTransactionActive = NewScardError(scard.E_INVALID_VALUE, CATEGORY_CLIENT_ERROR, "transaction already active")
+	errNotTransacted     = NewScardError(scard.E_NOT_TRANSACTED, CATEGORY_CLIENT_ERROR, "no active transaction")
+)
+
+// ErrTooLarge is the error of requests exceeding MaxRequestSize.
+var ErrTooLarge = NewScardError(scard.E_INVALID_PARAMETER, CATEGORY_CLIENT_ERROR, "request too large")
+
+// errParse reports a request that isn't valid JSON or doesn't match the
+// method's request.
+func errParse(err error) *ScardError {
+	return NewScardError(scard.E_INVALID_PARAMETER, CATEGORY_PARSE_ERROR, err.Error())
+}
+
+func errUnknownMethod(method string) *ScardError {
+	return NewScardError(scard.E_INVALID_PARAMETER, CATEGORY_UNKNOWN_METHOD, fmt.Sprintf("unknown method: %s", method))
+}
@@ -0,0 +1,51 @@
+package json
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+func TestToScardError(t *testing.T) {
+	tests := []struct {
+		err      error
+		code     scard.Error
+		name     string
+		category ErrorCategory
+	}{
+		{scard.W_REMOVED_CARD, scard.W_REMOVED_CARD, "SCARD_W_REMOVED_CARD", CATEGORY_CARD_REMOVED},
+		{scard.E_READER_UNAVAILABLE, scard.E_READER_UNAVAILABLE, "SCARD_E_READER_UNAVAILABLE", CATEGORY_READER_UNAVAILABLE},
+		{scard.E_NO_SERVICE, scard.E_NO_SERVICE, "SCARD_E_NO_SERVICE", CATEGORY_SERVICE_ERROR},
+		{errUnknownCtx, scard.E_INVALID_HANDLE, "SCARD_E_INVALID_HANDLE", CATEGORY_CLIENT_ERROR},
+		{errExpiredCard, scard.E_INVALID_HANDLE, "SCARD_E_INVALID_HANDLE", CATEGORY_EXPIRED},
+		{hex.InvalidByteError('x'), scard.E_INVALID_PARAMETER, "SCARD_E_INVALID_PARAMETER", CATEGORY_CLIENT_ERROR},
+		{errors.New("broken pipe"), scard.F_INTERNAL_ERROR, "SCARD_F_INTERNAL_ERROR", CATEGORY_INTERNAL_ERROR},
+		{scard.Error(0x80101234), scard.Error(0x80101234), "0x80101234", CATEGORY_INTERNAL_ERROR},
+	}
+	for _, test := range tests {
+		e := ToScardError(test.err)
+		if !e.HasCode(test.code) || e.Name != test.name || e.Category != test.category || e.Message == "" {
+			t.Errorf("%v: unexpected error object: %#v", test.err, e)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	var resp map[string]interface{}
+	virtualCall(t, `{"method":"status", "ctx":"ctx_unknown", "card":"card_unknown"}`, &resp)
+	e, ok := resp["error"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no error object: %v", resp)
+	}
+	if e["code"] != float64(scard.E_INVALID_HANDLE) || e["name"] != "SCARD_E_INVALID_HANDLE" || e["category"] != "CLIENT_ERROR" || e["message"] != "unknown card" {
+		t.Errorf("unexpected error object: %v", e)
+	}
+
+	resp = nil
+	virtualCall(t, `{"method":"version"}`, &resp)
+	if _, ok := resp["error"]; ok {
+		t.Errorf("error in successful response: %v", resp)
+	}
+}
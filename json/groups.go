@@ -0,0 +1,81 @@
+package json
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pcsc-lite puts every reader into SCard$DefaultReaders and doesn't
+// support adding groups, so additional groups are configured on the
+// server: each group maps to a list of reader names. A reader belongs to
+// the group if its name starts with one of the configured names, this
+// way the slot numbers pcsc-lite appends don't need to be spelled out.
+var readerGroups = make(map[string][]string)
+var readerGroupsLock sync.RWMutex
+
+// DefineReaderGroup adds (or replaces) a server side reader group.
+func DefineReaderGroup(group string, readers ...string) {
+	readerGroupsLock.Lock()
+	defer readerGroupsLock.Unlock()
+	readerGroups[group] = readers
+}
+
+// RemoveReaderGroup removes a group previously added with
+// DefineReaderGroup.
+func RemoveReaderGroup(group string) {
+	readerGroupsLock.Lock()
+	defer readerGroupsLock.Unlock()
+	delete(readerGroups, group)
+}
+
+// mergeReaderGroups returns the groups reported by PC/SC followed by the
+// server side groups in sorted order.
+func mergeReaderGroups(pcscGroups []string) (groups []string) {
+	readerGroupsLock.RLock()
+	defer readerGroupsLock.RUnlock()
+
+	names := make([]string, 0, len(readerGroups))
+	for group := range readerGroups {
+		if !contains(pcscGroups, group) {
+			names = append(names, group)
+		}
+	}
+	sort.Strings(names)
+	return append(append(groups, pcscGroups...), names...)
+}
+
+// filterReaders returns the readers belonging to any of the requested
+// groups. The PC/SC groups contain all readers.
+func filterReaders(readers []string, pcscGroups []string, requested []string) (filtered []string) {
+	readerGroupsLock.RLock()
+	defer readerGroupsLock.RUnlock()
+
+	filtered = []string{}
+	for _, group := range requested {
+		if contains(pcscGroups, group) {
+			return readers
+		}
+	}
+	for _, reader := range readers {
+	groups:
+		for _, group := range requested {
+			for _, prefix := range readerGroups[group] {
+				if strings.HasPrefix(reader, prefix) {
+					filtered = append(filtered, reader)
+					break groups
+				}
+			}
+		}
+	}
+	return
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
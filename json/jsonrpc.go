@@ -0,0 +1,131 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// JSON-RPC 2.0 compatibility: a request carrying "jsonrpc":"2.0" is
+// handled as JSON-RPC request, the method's fields are passed by name in
+// "params":
+//
+//	{"jsonrpc":"2.0", "id":1, "method":"connect",
+//	 "params":{"ctx":"ctx_..", "reader":"..", "shareMode":"SHARED", "protocol":"ANY"}}
+//
+// and answered with the usual response (without "error") as result:
+//
+//	{"jsonrpc":"2.0", "id":1, "result":{"card":"card_.."}}
+//
+// Failures use the standard error codes, PC/SC errors are reported as
+// JSONRPC_SERVER_ERROR. The ScardError is always passed in the error's
+// "data". Notifications (requests without "id") are run, but not
+// answered.
+
+const JSONRPC_VERSION = "2.0"
+
+const (
+	JSONRPC_PARSE_ERROR      = -32700
+	JSONRPC_INVALID_REQUEST  = -32600
+	JSONRPC_METHOD_NOT_FOUND = -32601
+	JSONRPC_INVALID_PARAMS   = -32602
+	JSONRPC_INTERNAL_ERROR   = -32603
+	JSONRPC_SERVER_ERROR     = -32000
+)
+
+var jsonrpcMessages = map[int]string{
+	JSONRPC_PARSE_ERROR:      "Parse error",
+	JSONRPC_INVALID_REQUEST:  "Invalid Request",
+	JSONRPC_METHOD_NOT_FOUND: "Method not found",
+	JSONRPC_INVALID_PARAMS:   "Invalid params",
+	JSONRPC_INTERNAL_ERROR:   "Internal error",
+}
+
+type JsonRpcRequest struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type JsonRpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    *ScardError `json:"data,omitempty"`
+}
+
+type JsonRpcResponse struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *JsonRpcError   `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// isJsonRpc reports whether req is a JSON-RPC request rather than a flat
+// {"method":..} one.
+func isJsonRpc(req json.RawMessage) bool {
+	probe := struct {
+		JsonRpc *json.RawMessage `json:"jsonrpc"`
+	}{}
+	return json.Unmarshal(req, &probe) == nil && probe.JsonRpc != nil
+}
+
+// jsonrpcError converts err to a JSON-RPC error with the given code,
+// code JSONRPC_SERVER_ERROR carries the ScardError's message.
+func jsonrpcError(code int, err error) *JsonRpcError {
+	e := ToScardError(err)
+	message, ok := jsonrpcMessages[code]
+	if !ok {
+		message = e.Message
+	}
+	return &JsonRpcError{code, message, e}
+}
+
+// jsonrpcFailure is the error response to a JSON-RPC request whose id
+// can't be determined, e.g. because it couldn't be parsed.
+func jsonrpcFailure(code int, err error) *JsonRpcResponse {
+	return &JsonRpcResponse{JsonRpc: JSONRPC_VERSION, Error: jsonrpcError(code, err), Id: json.RawMessage("null")}
+}
+
+// handleJsonRpc runs the JSON-RPC request req, the response is nil for
+// notifications.
+func handleJsonRpc(s *Session, req json.RawMessage) *JsonRpcResponse {
+	request := JsonRpcRequest{}
+	resp := &JsonRpcResponse{JsonRpc: JSONRPC_VERSION}
+	if err := decodeFully(bytes.NewReader(req), &request); err != nil {
+		resp.Error = jsonrpcError(JSONRPC_INVALID_REQUEST, err)
+		return resp
+	}
+	resp.Id = request.Id
+	switch {
+	case request.JsonRpc != JSONRPC_VERSION:
+		resp.Error = jsonrpcError(JSONRPC_INVALID_REQUEST, errParse(errors.New("unsupported jsonrpc version: "+request.JsonRpc)))
+		return resp
+	case request.Method == "":
+		resp.Error = jsonrpcError(JSONRPC_INVALID_REQUEST, errParse(errors.New("missing method")))
+		return resp
+	}
+
+	params := bytes.TrimSpace(request.Params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		params = []byte("{}")
+	} else if params[0] != '{' {
+		resp.Error = jsonrpcError(JSONRPC_INVALID_PARAMS, errParse(errors.New("params must be passed by name")))
+		return resp
+	}
+
+	if lookupMethod(request.Method) == nil {
+		resp.Error = jsonrpcError(JSONRPC_METHOD_NOT_FOUND, errUnknownMethod(request.Method))
+	} else if result, err := callMethod(s, request.Method, params); err == nil {
+		resp.Result = result
+	} else if ToScardError(err).Category == CATEGORY_PARSE_ERROR {
+		resp.Error = jsonrpcError(JSONRPC_INVALID_PARAMS, err)
+	} else {
+		resp.Error = jsonrpcError(JSONRPC_SERVER_ERROR, err)
+	}
+
+	if request.Id == nil {
+		return nil
+	}
+	return resp
+}
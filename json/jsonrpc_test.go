@@ -0,0 +1,104 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+func jsonrpcCall(t *testing.T, req string) (resp JsonRpcResponse, raw string) {
+	writer := &bytes.Buffer{}
+	if err := ScardJson(strings.NewReader(req), writer); err != nil {
+		t.Fatal(err)
+	}
+	raw = writer.String()
+	if raw == "" {
+		return
+	}
+	if err := json.Unmarshal(writer.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestJsonRpc(t *testing.T) {
+	resp, _ := jsonrpcCall(t, `{"jsonrpc":"2.0", "id":"a", "method":"establishContext"}`)
+	if resp.Error != nil || resp.JsonRpc != JSONRPC_VERSION || string(resp.Id) != `"a"` {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	ctx := Context(resp.Result.(map[string]interface{})["ctx"].(string))
+	defer releaseContext(ctx, LEAVE_CARD)
+
+	req := `{"jsonrpc":"2.0", "id":2, "method":"connect", "params":{"ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}}`
+	resp, raw := jsonrpcCall(t, fmt.Sprintf(req, ctx, virtualReader.Name))
+	if resp.Error != nil || string(resp.Id) != "2" {
+		t.Fatalf("unexpected response: %s", raw)
+	}
+	if strings.Contains(raw, `"error"`) {
+		t.Errorf("error in result: %s", raw)
+	}
+	card := resp.Result.(map[string]interface{})["card"].(string)
+
+	req = `{"jsonrpc":"2.0", "id":3, "method":"transmit", "params":{"ctx":"%s", "card":"%s", "data":"00A40000023F00"}}`
+	resp, raw = jsonrpcCall(t, fmt.Sprintf(req, ctx, card))
+	if resp.Error != nil || resp.Result.(map[string]interface{})["data"] != "9000" {
+		t.Errorf("unexpected response: %s", raw)
+	}
+
+	// notifications are run, but not answered.
+	req = `{"jsonrpc":"2.0", "method":"disconnect", "params":{"ctx":"%s", "card":"%s", "disposition":"LEAVE_CARD"}}`
+	if _, raw = jsonrpcCall(t, fmt.Sprintf(req, ctx, card)); raw != "" {
+		t.Errorf("notification answered: %s", raw)
+	}
+	if lookupCard(ctx, Card(card)) != nil {
+		t.Error("notification not run")
+	}
+}
+
+func TestJsonRpcErrors(t *testing.T) {
+	tests := []struct {
+		req  string
+		code int
+		data scard.Error
+	}{
+		{`{"jsonrpc":"1.0", "id":1, "method":"version"}`, JSONRPC_INVALID_REQUEST, scard.E_INVALID_PARAMETER},
+		{`{"jsonrpc":"2.0", "id":1}`, JSONRPC_INVALID_REQUEST, scard.E_INVALID_PARAMETER},
+		{`{"jsonrpc":"2.0", "id":1, "method":"version", "extra":1}`, JSONRPC_INVALID_REQUEST, scard.E_INVALID_PARAMETER},
+		{`{"jsonrpc":"2.0", "id":1, "method":"nonsense"}`, JSONRPC_METHOD_NOT_FOUND, scard.E_INVALID_PARAMETER},
+		{`{"jsonrpc":"2.0", "id":1, "method":"isValid", "params":["ctx_00"]}`, JSONRPC_INVALID_PARAMS, scard.E_INVALID_PARAMETER},
+		{`{"jsonrpc":"2.0", "id":1, "method":"isValid", "params":{"context":"ctx_00"}}`, JSONRPC_INVALID_PARAMS, scard.E_INVALID_PARAMETER},
+		{`{"jsonrpc":"2.0", "id":1, "method":"isValid", "params":{"ctx":"ctx_00"}}`, JSONRPC_SERVER_ERROR, scard.E_INVALID_HANDLE},
+	}
+	for _, test := range tests {
+		resp, raw := jsonrpcCall(t, test.req)
+		if resp.Error == nil || resp.Error.Code != test.code || !resp.Error.Data.HasCode(test.data) {
+			t.Errorf("%s: unexpected response: %s", test.req, raw)
+		}
+		if resp.Result != nil {
+			t.Errorf("%s: result in error response: %s", test.req, raw)
+		}
+	}
+}
+
+func TestJsonRpcParseError(t *testing.T) {
+	for _, req := range []string{`{"jsonrpc":"2.0", "id":1, "method":`, `[{"jsonrpc":"2.0", "id":1}`} {
+		resp, raw := jsonrpcCall(t, req)
+		if resp.Error == nil || resp.Error.Code != JSONRPC_PARSE_ERROR || string(resp.Id) != "null" {
+			t.Errorf("%s: unexpected response: %s", req, raw)
+		}
+		if !strings.Contains(raw, `"id":null`) {
+			t.Errorf("%s: id missing: %s", req, raw)
+		}
+	}
+
+	// flat requests keep their error.
+	resp := ScardResponse{}
+	virtualCall(t, `{"method":`, &resp)
+	if resp.Error == nil || resp.Error.Category != CATEGORY_PARSE_ERROR {
+		t.Errorf("unexpected response: %v", resp.Error)
+	}
+}
@@ -0,0 +1,162 @@
+package json
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// A method is a JSON request handler, see RegisterMethod.
+type method struct {
+	handler  reflect.Value
+	session  bool
+	request  reflect.Type
+	response reflect.Type
+}
+
+var methodsLock sync.RWMutex
+var methods = make(map[string]*method)
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	sessionType = reflect.TypeOf((*Session)(nil))
+	contextType = reflect.TypeOf(Context(""))
+)
+
+// RegisterMethod makes handler available as the JSON method name.
+// handler must be a func(req *R, resp *S) error where R is the request
+// struct (usually embedding ScardRequest) and S the response struct
+// (embedding ScardResponse). The request is decoded into a new R, on
+// success the S filled in by handler is sent, otherwise only the error.
+//
+// Handlers running further requests (like batch) or establishing contexts
+// may take the *Session the request is run in as additional first
+// argument, it's nil outside of sessions.
+func RegisterMethod(name string, handler interface{}) {
+	v := reflect.ValueOf(handler)
+	t := v.Type()
+	session := t.Kind() == reflect.Func && t.NumIn() == 3 && t.In(0) == sessionType
+	in := 0
+	if session {
+		in = 1
+	}
+	if t.Kind() != reflect.Func || t.NumIn() != in+2 || t.NumOut() != 1 ||
+		t.In(in).Kind() != reflect.Ptr || t.In(in+1).Kind() != reflect.Ptr || t.Out(0) != errorType {
+		panic("invalid handler for " + name + ": " + t.String())
+	}
+
+	methodsLock.Lock()
+	defer methodsLock.Unlock()
+	methods[name] = &method{v, session, t.In(in).Elem(), t.In(in + 1).Elem()}
+}
+
+// Methods returns the names of all registered methods.
+func Methods() []string {
+	methodsLock.RLock()
+	defer methodsLock.RUnlock()
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupMethod(name string) *method {
+	methodsLock.RLock()
+	defer methodsLock.RUnlock()
+	return methods[name]
+}
+
+// call decodes params into a new request and runs the handler. In a
+// session, requests naming a context ("ctx") not established through
+// the session are rejected.
+func (m *method) call(s *Session, params json.RawMessage) (resp interface{}, err error) {
+	req := reflect.New(m.request)
+	if err = decodeFully(bytes.NewReader(params), req.Interface()); err != nil {
+		return nil, err
+	}
+	if ctx := req.Elem().FieldByName("Ctx"); ctx.IsValid() && ctx.Type() == contextType {
+		if tok := ctx.Interface().(Context); tok != "" && !s.owns(tok) {
+			return nil, errUnknownCtx
+		}
+	}
+
+	response := reflect.New(m.response)
+	args := []reflect.Value{req, response}
+	if m.session {
+		args = append([]reflect.Value{reflect.ValueOf(s)}, args...)
+	}
+	if out := m.handler.Call(args); !out[0].IsNil() {
+		return nil, out[0].Interface().(error)
+	}
+	if established, ok := response.Interface().(*ScardContextResponse); ok {
+		s.add(established.Ctx)
+	}
+	return response.Interface(), nil
+}
+
+// callMethod runs the method name with params, the request's fields.
+func callMethod(s *Session, name string, params json.RawMessage) (resp interface{}, err error) {
+	m := lookupMethod(name)
+	if m == nil {
+		return nil, errUnknownMethod(name)
+	}
+	return m.call(s, params)
+}
+
+// dispatch runs the request req, the method is taken from its "method"
+// field.
+func dispatch(s *Session, req json.RawMessage) (resp interface{}, err error) {
+	envelope := ScardRequest{}
+	if err = json.Unmarshal(req, &envelope); err != nil {
+		return nil, errParse(err)
+	}
+	return callMethod(s, envelope.Method, req)
+}
+
+// errorResponse is the response sent for a failed request.
+func errorResponse(err error) *ScardResponse {
+	return &ScardResponse{Error: ToScardError(err)}
+}
+
+// ResponseError returns the error of a failed flat request's response,
+// nil for successful requests, JSON-RPC requests and batches.
+func ResponseError(resp interface{}) *ScardError {
+	if resp, ok := resp.(*ScardResponse); ok {
+		return resp.Error
+	}
+	return nil
+}
+
+// requestReader limits a request to MaxRequestSize and keeps read errors
+// apart from malformed input, the decoder returns both alike.
+type requestReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *requestReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if r.n -= int64(n); r.n < 0 {
+		err = ErrTooLarge
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return
+}
+
+// readRequest reads a single JSON value of at most MaxRequestSize bytes
+// from r.
+func readRequest(r io.Reader) (req json.RawMessage, err error) {
+	reader := &requestReader{r: r, n: MaxRequestSize}
+	if err = decodeFully(reader, &req); reader.err != nil {
+		return nil, reader.err
+	}
+	return
+}
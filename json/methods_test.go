@@ -0,0 +1,70 @@
+package json
+
+import (
+	"testing"
+)
+
+type echoRequest struct {
+	ScardRequest
+	Text string `json:"text"`
+}
+
+type echoResponse struct {
+	ScardResponse
+	Text string `json:"text"`
+}
+
+func echo(req *echoRequest, resp *echoResponse) error {
+	if req.Text == "" {
+		return errIncorrectParam
+	}
+	resp.Text = req.Text
+	return nil
+}
+
+func TestRegisterMethod(t *testing.T) {
+	RegisterMethod("echo", echo)
+	defer func() {
+		methodsLock.Lock()
+		delete(methods, "echo")
+		methodsLock.Unlock()
+	}()
+
+	if !contains(Methods(), "echo") {
+		t.Fatalf("echo not registered: %v", Methods())
+	}
+
+	resp := echoResponse{}
+	virtualCall(t, `{"method":"echo", "text":"hello"}`, &resp)
+	if resp.Error != nil || resp.Text != "hello" {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	resp = echoResponse{}
+	virtualCall(t, `{"method":"echo"}`, &resp)
+	if resp.Error == nil || *resp.Error != *errIncorrectParam || resp.Text != "" {
+		t.Errorf("unexpected response: %v", resp)
+	}
+}
+
+func TestRegisterInvalidMethod(t *testing.T) {
+	for _, handler := range []interface{}{
+		nil,
+		"echo",
+		func(req *echoRequest) error { return nil },
+		func(req echoRequest, resp *echoResponse) error { return nil },
+		func(req *echoRequest, resp *echoResponse) {},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%T accepted as handler", handler)
+				}
+			}()
+			RegisterMethod("invalid", handler)
+		}()
+	}
+	if lookupMethod("invalid") != nil {
+		t.Error("invalid handler registered")
+	}
+}
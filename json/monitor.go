@@ -0,0 +1,233 @@
+package json
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+// EventType is the kind of change an Event reports, see Subscribe.
+type EventType string
+
+const (
+	EVENT_READER_ADDED   EventType = "READER_ADDED"
+	EVENT_READER_REMOVED EventType = "READER_REMOVED"
+	EVENT_CARD_PRESENT   EventType = "CARD_PRESENT"
+	EVENT_CARD_ABSENT    EventType = "CARD_ABSENT"
+	// a card is present but doesn't answer, e.g. inserted the wrong way.
+	EVENT_CARD_MUTE EventType = "CARD_MUTE"
+)
+
+// Event is a change of a reader, the ATR is set for cards present.
+type Event struct {
+	Event  EventType `json:"event"`
+	Reader string    `json:"reader"`
+	ATR    string    `json:"atr,omitempty"`
+}
+
+// MonitorRetryInterval is how long the monitor waits before trying again
+// when PC/SC fails, e.g. because the service isn't running.
+var MonitorRetryInterval = 5 * time.Second
+
+// monitorTimeout bounds the monitor's waits for changes, it's cancelled
+// when stopped but may miss the cancellation just before waiting.
+const monitorTimeout = time.Minute
+
+// monitor watches all readers of the default backend using a single
+// context of its own while anyone is subscribed.
+type monitor struct {
+	lock        sync.Mutex
+	subscribers map[chan<- Event]bool
+	// the card event of each known reader, empty until it's known.
+	readers map[string]Event
+	// closed to stop the running monitor, nil while nobody's subscribed.
+	stop chan bool
+}
+
+var events = &monitor{
+	subscribers: make(map[chan<- Event]bool),
+	readers:     make(map[string]Event),
+}
+
+// Subscribe sends the events of all readers to ch until unsubscribe is
+// called. The current state is sent first, as READER_ADDED event and card
+// event for each reader. Events are dropped for subscribers not keeping
+// up, ch should be buffered.
+func Subscribe(ch chan<- Event) (unsubscribe func()) {
+	m := events
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stop == nil {
+		m.stop = make(chan bool)
+		go m.run(m.stop)
+	}
+	m.subscribers[ch] = true
+
+	names := make([]string, 0, len(m.readers))
+	for name := range m.readers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		send(ch, Event{Event: EVENT_READER_ADDED, Reader: name})
+		if e := m.readers[name]; e.Event != "" {
+			send(ch, e)
+		}
+	}
+
+	return func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if !m.subscribers[ch] {
+			return
+		}
+		delete(m.subscribers, ch)
+		if len(m.subscribers) == 0 {
+			close(m.stop)
+			m.stop = nil
+			m.readers = make(map[string]Event)
+		}
+	}
+}
+
+func send(ch chan<- Event, e Event) {
+	select {
+	case ch <- e:
+	default:
+	}
+}
+
+// emit records e and sends it to all subscribers, unless the monitor
+// run stopped belongs to has been stopped.
+func (m *monitor) emit(stop chan bool, e Event) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != stop {
+		return
+	}
+	switch e.Event {
+	case EVENT_READER_ADDED:
+		m.readers[e.Reader] = Event{}
+	case EVENT_READER_REMOVED:
+		delete(m.readers, e.Reader)
+	default:
+		if m.readers[e.Reader] == e {
+			// e.g. a change of STATE_INUSE.
+			return
+		}
+		m.readers[e.Reader] = e
+	}
+	for ch := range m.subscribers {
+		send(ch, e)
+	}
+}
+
+// run watches the readers until stop is closed, PC/SC failures are
+// reported as removal of all readers.
+func (m *monitor) run(stop chan bool) {
+	known := make(map[string]scard.StateFlag)
+	for {
+		m.watch(stop, known)
+		for name := range known {
+			delete(known, name)
+			m.emit(stop, Event{Event: EVENT_READER_REMOVED, Reader: name})
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(MonitorRetryInterval):
+		}
+	}
+}
+
+// watch reports changes of the readers until stop is closed or PC/SC
+// fails. known holds the state of the readers reported so far.
+func (m *monitor) watch(stop chan bool, known map[string]scard.StateFlag) {
+	ctx, err := DefaultBackend().EstablishContext()
+	if err != nil {
+		return
+	}
+	defer ctx.Release()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			ctx.Cancel()
+		case <-done:
+		}
+	}()
+
+	pnp := scard.ReaderState{Reader: PNP_NOTIFICATION}
+	for {
+		readers, err := ctx.ListReaders()
+		if err != nil && err != scard.E_NO_READERS_AVAILABLE {
+			return
+		}
+
+		present := make(map[string]bool)
+		for _, name := range readers {
+			present[name] = true
+			if _, ok := known[name]; !ok {
+				known[name] = scard.STATE_UNAWARE
+				m.emit(stop, Event{Event: EVENT_READER_ADDED, Reader: name})
+			}
+		}
+		for name := range known {
+			if !present[name] {
+				delete(known, name)
+				m.emit(stop, Event{Event: EVENT_READER_REMOVED, Reader: name})
+			}
+		}
+
+		states := []scard.ReaderState{pnp}
+		for _, name := range readers {
+			states = append(states, scard.ReaderState{Reader: name, CurrentState: known[name]})
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err = ctx.GetStatusChange(states, monitorTimeout); err == scard.E_TIMEOUT {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		pnp.CurrentState = states[0].EventState &^ scard.STATE_CHANGED
+		for _, rs := range states[1:] {
+			if rs.EventState&scard.STATE_CHANGED == 0 {
+				continue
+			}
+			known[rs.Reader] = rs.EventState &^ scard.STATE_CHANGED
+			if e, ok := cardEvent(rs); ok {
+				m.emit(stop, e)
+			}
+		}
+	}
+}
+
+// cardEvent returns the event for the card state of rs, there's none for
+// readers that went away.
+func cardEvent(rs scard.ReaderState) (e Event, ok bool) {
+	e.Reader = rs.Reader
+	switch state := rs.EventState; {
+	case state&(scard.STATE_UNKNOWN|scard.STATE_UNAVAILABLE) != 0:
+		return e, false
+	case state&scard.STATE_MUTE != 0:
+		e.Event = EVENT_CARD_MUTE
+	case state&scard.STATE_PRESENT != 0:
+		e.Event = EVENT_CARD_PRESENT
+	default:
+		e.Event = EVENT_CARD_ABSENT
+	}
+	if e.Event != EVENT_CARD_ABSENT {
+		e.ATR = hex.EncodeToString(rs.Atr)
+	}
+	return e, true
+}
@@ -0,0 +1,61 @@
+package json
+
+import (
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of reader, skipping other readers'.
+func nextEvent(t *testing.T, ch <-chan Event, reader string) Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if e.Reader == reader {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no event for %s", reader)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	const name = "Virtual Reader Monitor"
+	ch := make(chan Event, 16)
+	unsubscribe := Subscribe(ch)
+	defer unsubscribe()
+
+	rdr := virtual.AddReader(name)
+	expect := func(expected Event) {
+		if e := nextEvent(t, ch, name); e != expected {
+			t.Errorf("expected %v, got %v", expected, e)
+		}
+	}
+	expect(Event{EVENT_READER_ADDED, name, ""})
+	expect(Event{EVENT_CARD_ABSENT, name, ""})
+
+	rdr.Insert(NewVirtualCard([]byte{0x3B, 0x01}, nil))
+	expect(Event{EVENT_CARD_PRESENT, name, "3b01"})
+
+	// late subscribers get the current state.
+	late := make(chan Event, 16)
+	unsubscribeLate := Subscribe(late)
+	if e := nextEvent(t, late, name); e.Event != EVENT_READER_ADDED {
+		t.Errorf("unexpected event: %v", e)
+	}
+	if e := nextEvent(t, late, name); e.Event != EVENT_CARD_PRESENT {
+		t.Errorf("unexpected event: %v", e)
+	}
+	unsubscribeLate()
+
+	rdr.Remove()
+	expect(Event{EVENT_CARD_ABSENT, name, ""})
+	mute := NewVirtualCard([]byte{0x3B, 0x02}, nil)
+	mute.Mute = true
+	rdr.Insert(mute)
+	expect(Event{EVENT_CARD_MUTE, name, "3b02"})
+
+	virtual.RemoveReader(name)
+	expect(Event{EVENT_READER_REMOVED, name, ""})
+}
@@ -0,0 +1,83 @@
+package json
+
+import "time"
+
+// Idle timeouts after which the reaper releases contexts and disconnects
+// cards nobody used, zero disables reaping for the handle type. Using a
+// card also counts as using its context. Clients using a reaped token
+// receive the error "EXPIRED".
+var (
+	ContextIdleTimeout = 30 * time.Minute
+	CardIdleTimeout    = 5 * time.Minute
+)
+
+// reaped tokens are reported as EXPIRED for this long, afterwards they are
+// UNKNOWN.
+var ExpiredRetention = 24 * time.Hour
+
+// StartReaper checks for idle handles every interval until stop is
+// closed.
+func StartReaper(interval time.Duration) (stop chan<- bool) {
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				reap(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// busy keeps the reaper away from ctx and card (if not empty) while a
+// possibly blocking call like getStatusChange is in progress, done must
+// be called when it returns.
+func busy(ctx Context, card Card) (done func()) {
+	handles := []*handle{contexts.lookup(string(ctx))}
+	if card != "" {
+		handles = append(handles, cards.lookup(string(card)))
+	}
+	for _, h := range handles {
+		if h != nil {
+			h.enter()
+		}
+	}
+	return func() {
+		for _, h := range handles {
+			if h != nil {
+				h.leave()
+			}
+		}
+	}
+}
+
+// reap disconnects cards and releases contexts that have been idle for
+// longer than their timeout.
+func reap(now time.Time) {
+	if CardIdleTimeout != 0 {
+		cards.each(func(tok string, h *handle) {
+			if h.idle(now) > CardIdleTimeout && cards.expire(tok) != nil {
+				abandonTransaction(h)
+				_ = h.card.Disconnect(ReleaseDisposition.Scard())
+			}
+		})
+	}
+	if ContextIdleTimeout != 0 {
+		contexts.each(func(tok string, h *handle) {
+			if h.idle(now) <= ContextIdleTimeout {
+				return
+			}
+			disconnectCards(Context(tok), ReleaseDisposition, cards.expire)
+			if contexts.expire(tok) != nil {
+				_ = h.ctx.Release()
+			}
+		})
+	}
+	contexts.forget(now.Add(-ExpiredRetention))
+	cards.forget(now.Add(-ExpiredRetention))
+}
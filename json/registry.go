@@ -0,0 +1,159 @@
+package json
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handle is the server side state a Context or Card token refers to.
+type handle struct {
+	ctx  BackendContext // set for contexts
+	card BackendCard    // set for cards
+	// the context a card was connected with, cards are only accepted
+	// together with their parent context.
+	parent Context
+
+	lock sync.Mutex
+	// disposition to end an open transaction with in case the client goes
+	// away without calling endTransaction, nil if no transaction is open.
+	transaction *Disposition
+	// set while beginTransaction waits for the card, which isn't done
+	// holding lock. abandoned tells it to end the transaction right away.
+	beginning, abandoned bool
+
+	// last use in UnixNano, accessed atomically.
+	used int64
+	// number of (possibly blocking) calls in progress, accessed
+	// atomically.
+	calls int32
+}
+
+func (h *handle) touch() {
+	atomic.StoreInt64(&h.used, time.Now().UnixNano())
+}
+
+// enter marks the handle as used until leave is called.
+func (h *handle) enter() {
+	atomic.AddInt32(&h.calls, 1)
+	h.touch()
+}
+
+func (h *handle) leave() {
+	h.touch()
+	atomic.AddInt32(&h.calls, -1)
+}
+
+// idle returns how long the handle hasn't been used, handles with calls in
+// progress aren't idle.
+func (h *handle) idle(now time.Time) time.Duration {
+	if atomic.LoadInt32(&h.calls) != 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&h.used)))
+}
+
+// registry maps tokens to handles, it's safe for concurrent use by
+// multiple goroutines (i.e. requests).
+type registry struct {
+	lock    sync.RWMutex
+	handles map[string]*handle
+	// tokens removed by expire and when that happened.
+	expiredAt map[string]time.Time
+}
+
+func newRegistry() *registry {
+	return &registry{
+		handles:   make(map[string]*handle),
+		expiredAt: make(map[string]time.Time),
+	}
+}
+
+// lookup returns the handle for token or nil, looking up a handle counts
+// as using it.
+func (r *registry) lookup(token string) *handle {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	h := r.handles[token]
+	if h != nil {
+		h.touch()
+	}
+	return h
+}
+
+// has reports whether token is registered without counting as use.
+func (r *registry) has(token string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.handles[token] != nil
+}
+
+func (r *registry) insert(token string, h *handle) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	h.touch()
+	r.handles[token] = h
+}
+
+// remove deletes token and returns the handle it referred to, or nil if
+// it wasn't registered. Only one of several concurrent callers removing
+// the same token receives the handle.
+func (r *registry) remove(token string) (h *handle) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if h = r.handles[token]; h != nil {
+		delete(r.handles, token)
+	}
+	return
+}
+
+// expire removes token like remove, but remembers that it expired.
+func (r *registry) expire(token string) (h *handle) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if h = r.handles[token]; h != nil {
+		delete(r.handles, token)
+		r.expiredAt[token] = time.Now()
+	}
+	return
+}
+
+// expired reports whether token was removed by expire.
+func (r *registry) expired(token string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	_, ok := r.expiredAt[token]
+	return ok
+}
+
+// forget drops the expired tokens that expired before t.
+func (r *registry) forget(t time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for token, at := range r.expiredAt {
+		if at.Before(t) {
+			delete(r.expiredAt, token)
+		}
+	}
+}
+
+// each calls f for a snapshot of all registered handles, f may modify the
+// registry.
+func (r *registry) each(f func(token string, h *handle)) {
+	r.lock.RLock()
+	snapshot := make(map[string]*handle, len(r.handles))
+	for token, h := range r.handles {
+		snapshot[token] = h
+	}
+	r.lock.RUnlock()
+
+	for token, h := range snapshot {
+		f(token, h)
+	}
+}
+
+func (r *registry) len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.handles)
+}
@@ -0,0 +1,113 @@
+package json
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run with -race
+func TestRegistryConcurrent(t *testing.T) {
+	r := newRegistry()
+	wg := sync.WaitGroup{}
+
+	for i := 0; i != 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j != 100; j++ {
+				token := fmt.Sprintf("%d-%d", i, j)
+				h := &handle{}
+				r.insert(token, h)
+				if r.lookup(token) != h {
+					t.Errorf("lookup %s: wrong handle", token)
+				}
+				r.each(func(string, *handle) {})
+				if r.remove(token) != h {
+					t.Errorf("remove %s: wrong handle", token)
+				}
+				if r.remove(token) != nil {
+					t.Errorf("removed %s twice", token)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if r.len() != 0 {
+		t.Errorf("expected empty registry, got %d handles", r.len())
+	}
+}
+
+func TestRegistryEachMayModify(t *testing.T) {
+	r := newRegistry()
+	for i := 0; i != 10; i++ {
+		r.insert(fmt.Sprint(i), &handle{})
+	}
+	count := 0
+	r.each(func(token string, _ *handle) {
+		r.remove(token)
+		count++
+	})
+	if count != 10 || r.len() != 0 {
+		t.Errorf("visited %d, %d left", count, r.len())
+	}
+}
+
+func TestRegistryExpire(t *testing.T) {
+	r := newRegistry()
+	r.insert("a", &handle{})
+	r.insert("b", &handle{})
+
+	if r.expire("a") == nil {
+		t.Fatal("expire didn't return the handle")
+	}
+	r.remove("b")
+
+	if r.lookup("a") != nil {
+		t.Error("expired handle still registered")
+	}
+	if !r.expired("a") {
+		t.Error("a not reported as expired")
+	}
+	if r.expired("b") {
+		t.Error("removed handle reported as expired")
+	}
+
+	r.forget(time.Now().Add(time.Second))
+	if r.expired("a") {
+		t.Error("a still reported as expired after forget")
+	}
+}
+
+func TestHandleIdle(t *testing.T) {
+	r := newRegistry()
+	h := &handle{}
+	r.insert("a", h)
+
+	later := time.Now().Add(time.Minute)
+	if idle := h.idle(later); idle < 59*time.Second {
+		t.Errorf("unexpected idle time: %s", idle)
+	}
+	time.Sleep(10 * time.Millisecond)
+	r.lookup("a")
+	if idle := h.idle(time.Now()); idle >= 10*time.Millisecond {
+		t.Errorf("lookup didn't touch handle, idle: %s", idle)
+	}
+}
+
+func TestHandleBusy(t *testing.T) {
+	h := &handle{}
+	h.touch()
+	later := time.Now().Add(time.Minute)
+
+	h.enter()
+	if idle := h.idle(later); idle != 0 {
+		t.Errorf("busy handle idle for %s", idle)
+	}
+	h.leave()
+	if idle := h.idle(later); idle < 59*time.Second {
+		t.Errorf("unexpected idle time: %s", idle)
+	}
+}
@@ -2,363 +2,597 @@ package json
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
-	"strconv"
 	"time"
 )
 
 import "github.com/ebfe/go.pcsclite/scard"
 
-// need to map:
+// MaxRequestSize limits the size of a request body in bytes.
+var MaxRequestSize int64 = 64 * 1024
 
+// decodeFully decodes exactly one JSON value from r into into. Unknown
+// fields and anything following the value are rejected, failures are
+// returned as PARSE_ERROR.
 func decodeFully(r io.Reader, into interface{}) (err error) {
 	decoder := json.NewDecoder(r)
-	for {
-		if err = decoder.Decode(into); err == io.EOF {
-			break
-		} else {
-			if err != nil {
-				return nil
-			}
-		}
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(into); err != nil {
+		return errParse(err)
 	}
-	return nil
-}
-
-func encodeError(mes string, w io.Writer) (err error) {
-	resp := ScardResponse{Error: mes}
-	encoder := json.NewEncoder(w)
-	if err = encoder.Encode(resp); err != nil {
-		return
+	if _, err = decoder.Token(); err == nil {
+		return errParse(errors.New("trailing data after request"))
+	} else if err != io.EOF {
+		return errParse(err)
 	}
 	return nil
 }
 
+// ScardJson reads a single request from r and writes the response to w.
+// Both flat requests and JSON-RPC 2.0 requests (see jsonrpc.go) are
+// accepted, alone or in a batch. Nothing is written for JSON-RPC
+// notifications.
 func ScardJson(r io.Reader, w io.Writer) (err error) {
-	buffer := bytes.Buffer{}
-	io.Copy(&buffer, r)
+	return writeResponse(scardJsonResponse(nil, r), w)
+}
 
-	buffer2 := bytes.NewBuffer(buffer.Bytes())
+// ScardJsonResponse is ScardJson returning the response instead of
+// writing it, e.g. to examine it using ResponseError.
+func ScardJsonResponse(r io.Reader) interface{} {
+	return scardJsonResponse(nil, r)
+}
 
-	var message = ScardRequest{}
-	if err = decodeFully(&buffer, &message); err != nil {
-		return
+func scardJsonResponse(s *Session, r io.Reader) interface{} {
+	raw := &bytes.Buffer{}
+	req, err := readRequest(io.TeeReader(r, raw))
+	if err != nil {
+		// answer JSON-RPC clients in kind, as far as they can be told.
+		if ToScardError(err).Category == CATEGORY_PARSE_ERROR && bytes.Contains(raw.Bytes(), []byte(`"jsonrpc"`)) {
+			return jsonrpcFailure(JSONRPC_PARSE_ERROR, err)
+		}
+		return errorResponse(err)
 	}
+	return handleRequest(s, req)
+}
 
-	//fmt.Printf(">%v<", message)
+// RejectResponse is the response to the request read from r failing
+// with err without being run, e.g. because the server is busy. JSON-RPC
+// requests get a JSON-RPC error, nil for notifications.
+func RejectResponse(r io.Reader, err error) interface{} {
+	req, rerr := readRequest(r)
+	if rerr != nil || isBatch(req) || !isJsonRpc(req) {
+		return errorResponse(err)
+	}
+	request := JsonRpcRequest{}
+	if json.Unmarshal(req, &request) != nil {
+		return jsonrpcFailure(JSONRPC_SERVER_ERROR, err)
+	}
+	if request.Id == nil {
+		return nil
+	}
+	return &JsonRpcResponse{JsonRpc: JSONRPC_VERSION, Error: jsonrpcError(JSONRPC_SERVER_ERROR, err), Id: request.Id}
+}
 
-	switch message.Method {
-	case "version":
-		return ScardVersion(buffer2, w)
-	case "establishContext":
-		return ScardEstablishContext(buffer2, w)
-	case "releaseContext":
-		return ScardReleaseContext(buffer2, w)
-	case "isValid":
-		return ScardIsValid(buffer2, w)
-	case "listReaders":
-		return ScardListReaders(buffer2, w)
-	case "connect":
-		return ScardConnect(buffer2, w)
-	case "status":
-		return ScardStatus(buffer2, w)
-	case "disconnect":
-		return ScardDisconnect(buffer2, w)
-	case "transmit":
-		return ScardTransmit(buffer2, w)
+func writeResponse(resp interface{}, w io.Writer) error {
+	if resp == nil {
+		return nil
+	}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(resp)
+}
 
-	default:
-		return encodeError(fmt.Sprintf("unknown method: %s", message.Method), w)
+// handleRequest runs a flat or JSON-RPC request or a batch of them (see
+// batch.go) and returns the response to send, or nil if there is none.
+func handleRequest(s *Session, req json.RawMessage) interface{} {
+	if isBatch(req) {
+		return handleBatch(s, req)
+	}
+	if isJsonRpc(req) {
+		// keep a nil *JsonRpcResponse from becoming a non-nil interface.
+		if resp := handleJsonRpc(s, req); resp != nil {
+			return resp
+		}
+		return nil
 	}
+	resp, err := dispatch(s, req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return resp
+}
+
+func init() {
+	RegisterMethod("version", version)
+	RegisterMethod("establishContext", establishContext)
+	RegisterMethod("releaseContext", release)
+	RegisterMethod("isValid", isValid)
+	RegisterMethod("cancel", cancel)
+	RegisterMethod("listReaders", listReaders)
+	RegisterMethod("listReaderGroups", listReaderGroups)
+	RegisterMethod("getStatusChange", getStatusChange)
+	RegisterMethod("connect", connect)
+	RegisterMethod("reconnect", reconnect)
+	RegisterMethod("disconnect", disconnect)
+	RegisterMethod("status", status)
+	RegisterMethod("beginTransaction", beginTransaction)
+	RegisterMethod("endTransaction", endTransaction)
+	RegisterMethod("transmit", transmit)
+	RegisterMethod("control", control)
+	RegisterMethod("getAttrib", getAttrib)
+	RegisterMethod("setAttrib", setAttrib)
+	RegisterMethod("batch", batch)
 }
 
-type scardFunc func(r io.Reader, w io.Writer) (err error)
+func version(s *Session, req *ScardRequest, resp *ScardVersionResponse) (err error) {
+	resp.Version = s.Backend().Version()
+	return nil
+}
 
-func scardTemplate(method string, f scardFunc, r io.Reader, w io.Writer) (err error) {
-	req := ScardRequest{}
+var contexts = newRegistry()
+var cards = newRegistry()
 
-	if err = decodeFully(r, &req); err != nil {
+const (
+	CTX_PREFIX  = "ctx_"
+	CARD_PREFIX = "card_"
+)
+
+// genToken generates an unguessable token representing a card or
+// context, prefix is one of CTX_PREFIX or CARD_PREFIX.
+func genToken(prefix string) (token string, err error) {
+	bytes := make([]byte, 16)
+	if _, err = rand.Read(bytes); err != nil {
 		return
 	}
+	return prefix + hex.EncodeToString(bytes), nil
+}
 
-	switch req.Method {
-	case method:
-		return f(r, w)
-	default:
-		return encodeError(fmt.Sprintf("incorrect method: %s", req.Method), w)
+func establishContext(s *Session, req *ScardRequest, resp *ScardContextResponse) (err error) {
+	var ctx BackendContext
+	if ctx, err = s.Backend().EstablishContext(); err != nil {
+		return
+	}
+	var tok string
+	if tok, err = genToken(CTX_PREFIX); err != nil {
+		ctx.Release()
+		return
 	}
+	contexts.insert(tok, &handle{ctx: ctx})
+	resp.Ctx = Context(tok)
+	return nil
 }
 
-func ScardVersion(r io.Reader, w io.Writer) (err error) {
-	f := func(r io.Reader, w io.Writer) (err error) {
-		res := ScardVersionResponse{}
-		res.Error = "0"
-		res.Version = scard.Version()
-		encoder := json.NewEncoder(w)
-		return encoder.Encode(res)
+// ReleaseDisposition is used to disconnect the cards still connected
+// when their context is released and the client didn't specify a
+// disposition. It defaults to what PC/SC does on SCardReleaseContext.
+var ReleaseDisposition = RESET_CARD
+
+// releaseContext removes the context and all cards connected through it
+// from the registries, disconnects the cards and releases the context.
+func releaseContext(tok Context, disposition Disposition) (err error) {
+	h := contexts.remove(string(tok))
+	if h == nil {
+		return nil
 	}
-	return scardTemplate("version", f, r, w)
+	disconnectCards(tok, disposition, cards.remove)
+	return h.ctx.Release()
 }
 
-var contexts = make(map[Context]*scard.Context)
-var cards = make(map[Card]*scard.Card)
-
-// generates string tokens representing cards and contexts
-func genToken() string {
-	return strconv.FormatInt(time.Now().UnixNano(), 16)
+// disconnectCards disconnects all cards connected using ctx after taking
+// them out of the registry with remove (cards.remove or cards.expire).
+func disconnectCards(ctx Context, disposition Disposition, remove func(string) *handle) {
+	cards.each(func(card string, child *handle) {
+		if child.parent == ctx && remove(card) != nil {
+			abandonTransaction(child)
+			_ = child.card.Disconnect(disposition.Scard())
+		}
+	})
 }
 
-func ScardEstablishContext(r io.Reader, w io.Writer) (err error) {
-
-	f := func(r io.Reader, w io.Writer) (err error) {
-		if ctx, serr := scard.EstablishContext(); serr != nil {
-			return encodeError(serr.Error(), w)
-		} else {
-			res := ScardContextResponse{}
-			res.Error = "0"
-
-			token := Context(genToken())
-			contexts[token] = ctx
-			res.Ctx = token
-
-			encoder := json.NewEncoder(w)
-			return encoder.Encode(res)
-		}
+// release disconnects all cards still connected using the context
+// with the optional "disposition" (default: ReleaseDisposition) and
+// releases the context.
+func release(req *ScardReleaseContextRequest, resp *ScardResponse) (err error) {
+	if req.Disposition == "" {
+		req.Disposition = ReleaseDisposition
 	}
-	return scardTemplate("establishContext", f, r, w)
-
+	if !req.Disposition.OK() {
+		return errIncorrectParam
+	}
+	if contexts.lookup(string(req.Ctx)) == nil {
+		return unknownCtx(req.Ctx)
+	}
+	return releaseContext(req.Ctx, req.Disposition)
 }
 
-type scardCtxFunc func(ctx *scard.Context, ctx_token Context, w io.Writer) (err error)
-
-func scardCtxTemplate(method string, f scardCtxFunc, r io.Reader, w io.Writer) (err error) {
-	req := ScardCtxRequest{}
+// cancel aborts a blocking call (e.g. getStatusChange) currently waiting
+// on the context, the blocked request returns SCARD_E_CANCELLED.
+func cancel(req *ScardCtxRequest, resp *ScardResponse) (err error) {
+	var ctx BackendContext
+	if ctx, err = lookupContext(req.Ctx); err != nil {
+		return
+	}
+	return ctx.Cancel()
+}
 
-	if err = decodeFully(r, &req); err != nil {
+func isValid(req *ScardCtxRequest, resp *ScardResponse) (err error) {
+	var ctx BackendContext
+	if ctx, err = lookupContext(req.Ctx); err != nil {
 		return
 	}
+	var valid bool
+	if valid, err = ctx.IsValid(); err == nil && !valid {
+		err = scard.E_INVALID_HANDLE
+	}
+	return
+}
 
-	switch req.Method {
-	case method:
-		scard_ctx := contexts[Context(req.Ctx)]
-		if scard_ctx == nil {
-			return encodeError("unknown ctx", w)
-		}
-		return f(scard_ctx, req.Ctx, w)
-	default:
-		return encodeError(fmt.Sprintf("incorrect method: %s", req.Method), w)
-	}
-}
-func ScardReleaseContext(r io.Reader, w io.Writer) (err error) {
-	f := func(ctx *scard.Context, tok Context, w io.Writer) (err error) {
-		if err = ctx.Release(); err != nil {
-			return encodeError(err.Error(), w)
-		} else {
-			contexts[tok] = nil
-			resp := ScardResponse{"0"}
-			encoder := json.NewEncoder(w)
-			return encoder.Encode(resp)
-		}
+// contextFor returns the PC/SC context for tok or nil.
+func contextFor(tok Context) BackendContext {
+	if h := contexts.lookup(string(tok)); h != nil {
+		return h.ctx
 	}
-	return scardCtxTemplate("releaseContext", f, r, w)
-}
-func ScardIsValid(r io.Reader, w io.Writer) (err error) {
-	f := func(ctx *scard.Context, _ Context, w io.Writer) (err error) {
-		if valid, err2 := ctx.IsValid(); err != nil {
-			return encodeError(err2.Error(), w)
-		} else {
-			if !valid {
-				return encodeError("INVALID_HANDLE", w)
-			} else {
-				return encodeError("0", w)
-			}
-		}
+	return nil
+}
+
+// unknownCtx returns the error for an unknown context token, or EXPIRED
+// if the reaper released it.
+func unknownCtx(tok Context) error {
+	if contexts.expired(string(tok)) {
+		return errExpiredCtx
+	}
+	return errUnknownCtx
+}
+
+// lookupContext returns the PC/SC context for tok without checking
+// whether it's still valid.
+func lookupContext(tok Context) (ctx BackendContext, err error) {
+	if ctx = contextFor(tok); ctx == nil {
+		return nil, unknownCtx(tok)
 	}
-	return scardCtxTemplate("isValid", f, r, w)
+	return
 }
 
-func checkContext(ctx *scard.Context, w io.Writer) (valid bool, err error) {
-	if ctx == nil {
-		return false, encodeError("UNKNOWN_CTX", w)
+// checkContext returns the valid PC/SC context for tok.
+func checkContext(tok Context) (ctx BackendContext, err error) {
+	if ctx, err = lookupContext(tok); err != nil {
+		return
 	}
+	var valid bool
 	if valid, err = ctx.IsValid(); err != nil {
-		return false, encodeError(err.Error(), w)
+		return nil, err
 	} else if !valid {
-		return false, encodeError("INVALID_HANDLE", w)
+		return nil, scard.E_INVALID_HANDLE
 	}
 	return
 }
 
-func ScardListReaders(r io.Reader, w io.Writer) (err error) {
-	f := func(ctx *scard.Context, _ Context, w io.Writer) (err error) {
-		var valid bool
-		if valid, err = checkContext(ctx, w); !valid {
+// listReaders lists all readers, or only those belonging to one of the
+// optional "groups".
+func listReaders(req *ScardListReadersRequest, resp *ScardListReadersResponse) (err error) {
+	var ctx BackendContext
+	if ctx, err = checkContext(req.Ctx); err != nil {
+		return
+	}
+	var readers []string
+	if readers, err = ctx.ListReaders(); err != nil {
+		return
+	}
+	if len(req.Groups) != 0 {
+		var groups []string
+		if groups, err = ctx.ListReaderGroups(); err != nil {
 			return
 		}
-		if readers, err2 := ctx.ListReaders(); err != nil {
-			return encodeError(err2.Error(), w)
-		} else {
-			resp := ScardListReadersResponse{}
-			resp.Error = "0"
-			resp.Readers = readers
-			encoder := json.NewEncoder(w)
-			return encoder.Encode(resp)
-		}
+		readers = filterReaders(readers, groups, req.Groups)
 	}
+	resp.Readers = readers
+	return nil
+}
 
-	return scardCtxTemplate("listReaders", f, r, w)
+func listReaderGroups(req *ScardCtxRequest, resp *ScardListReaderGroupsResponse) (err error) {
+	var ctx BackendContext
+	if ctx, err = checkContext(req.Ctx); err != nil {
+		return
+	}
+	var groups []string
+	if groups, err = ctx.ListReaderGroups(); err != nil {
+		return
+	}
+	resp.Groups = mergeReaderGroups(groups)
+	return nil
 }
 
-func connect(req *ScardConnectRequest, w io.Writer) (err error) {
-	ctx := contexts[req.Ctx]
-	var valid bool
-	if valid, err = checkContext(ctx, w); !valid {
-		return // checkContext already sent the error.
+func connect(req *ScardConnectRequest, resp *ScardConnectResponse) (err error) {
+	var ctx BackendContext
+	if ctx, err = checkContext(req.Ctx); err != nil {
+		return
 	}
 	if !req.Protocol.OK() || !req.ShareMode.OK() {
-		return encodeError("INCORRECT_PARAM", w)
+		return errIncorrectParam
 	}
 
-	var card *scard.Card
+	var card BackendCard
 	if card, err = ctx.Connect(req.Reader, req.ShareMode.Scard(), req.Protocol.Scard()); err != nil {
-		return encodeError(err.Error(), w)
-	} else {
-		jsoncard := Card(genToken())
-		cards[jsoncard] = card
-		resp := ScardConnectResponse{}
-		resp.Error = "0"
-		resp.Card = jsoncard
-		encoder := json.NewEncoder(w)
-		return encoder.Encode(resp)
+		return
+	}
+	var tok string
+	if tok, err = genToken(CARD_PREFIX); err != nil {
+		card.Disconnect(scard.LEAVE_CARD)
+		return
 	}
+	cards.insert(tok, &handle{card: card, parent: req.Ctx})
+	resp.Card = Card(tok)
+	return nil
 }
-func ScardConnect(r io.Reader, w io.Writer) (err error) {
-	req := ScardConnectRequest{}
 
-	if err = decodeFully(r, &req); err != nil {
-		return
+// lookupCard returns the handle for card or nil if card is unknown or
+// wasn't connected using ctx. Using a card counts as using its context.
+func lookupCard(ctx Context, card Card) *handle {
+	if h := cards.lookup(string(card)); h != nil && h.parent == ctx {
+		contexts.lookup(string(ctx))
+		return h
 	}
+	return nil
+}
 
-	switch req.Method {
-	case "connect":
-		return connect(&req, w)
-	default:
-		return encodeError(fmt.Sprintf("incorrect method: %s", req.Method), w)
+// unknownCard returns the error for an unknown card token, or EXPIRED if
+// the reaper disconnected it.
+func unknownCard(tok Card) error {
+	if cards.expired(string(tok)) {
+		return errExpiredCard
 	}
-	return
+	return errUnknownCard
 }
 
-func checkCard(card Card, w io.Writer) (scard *scard.Card, err error) {
-	scard_card := cards[card]
-	if scard_card == nil {
-		return nil, encodeError("UNKNOWN_CARD", w)
+func checkCard(ctx Context, card Card) (scard_card BackendCard, err error) {
+	h := lookupCard(ctx, card)
+	if h == nil {
+		return nil, unknownCard(card)
 	}
-	return scard_card, nil
+	return h.card, nil
 }
-func status(req *ScardStatusRequest, w io.Writer) (err error) {
-	var card *scard.Card
-	if card, err = checkCard(req.Card, w); card == nil {
+
+func status(req *ScardStatusRequest, resp *ScardStatusResponse) (err error) {
+	var card BackendCard
+	if card, err = checkCard(req.Ctx, req.Card); err != nil {
 		return
 	}
 
 	var status *scard.CardStatus
 	if status, err = card.Status(); err != nil {
-		return encodeError(err.Error(), w)
+		return
 	}
-	resp := ScardStatusResponse{}
-	resp.Error = "0"
 	resp.Card = req.Card
 	resp.Reader = status.Reader
+	resp.State = uint32(status.State)
 	resp.ActiveProtocol = ProtocolFromScard(status.ActiveProtocol)
 	resp.ATR = hex.EncodeToString(status.ATR)
-	encoder := json.NewEncoder(w)
-	return encoder.Encode(resp)
+	return nil
 }
-func ScardStatus(r io.Reader, w io.Writer) (err error) {
-	req := ScardStatusRequest{}
 
-	if err = decodeFully(r, &req); err != nil {
-		return
+func disconnect(req *ScardDisconnectRequest, resp *ScardResponse) (err error) {
+	if !req.Disposition.OK() {
+		return errIncorrectParam
 	}
-
-	switch req.Method {
-	case "status":
-		return status(&req, w)
-	default:
-		return encodeError(fmt.Sprintf("incorrect method: %s", req.Method), w)
+	// removing first ensures concurrent disconnects don't both reach
+	// the card.
+	if lookupCard(req.Ctx, req.Card) == nil {
+		return unknownCard(req.Card)
+	}
+	h := cards.remove(string(req.Card))
+	if h == nil {
+		return unknownCard(req.Card)
+	}
+	abandonTransaction(h)
+	if err = h.card.Disconnect(req.Disposition.Scard()); err != nil {
+		cards.insert(string(req.Card), h)
 	}
 	return
 }
 
-func ScardDisconnect(r io.Reader, w io.Writer) (err error) {
-	req := ScardDisconnectRequest{}
+// beginTransaction locks the card for exclusive use by this token until
+// endTransaction is called. The optional disposition is used to end the
+// transaction if the card is disconnected while it is still open.
+func beginTransaction(req *ScardBeginTransactionRequest, resp *ScardResponse) (err error) {
+	if req.Disposition == "" {
+		req.Disposition = LEAVE_CARD
+	}
+	if !req.Disposition.OK() {
+		return errIncorrectParam
+	}
+	h := lookupCard(req.Ctx, req.Card)
+	if h == nil {
+		return unknownCard(req.Card)
+	}
+	h.lock.Lock()
+	if h.transaction != nil || h.beginning {
+		h.lock.Unlock()
+		return errTransactionActive
+	}
+	h.beginning = true
+	h.lock.Unlock()
+
+	// blocks while another handle holds a transaction on the card.
+	done := busy(req.Ctx, req.Card)
+	err = h.card.BeginTransaction()
+	done()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.beginning = false
+	if err != nil {
+		h.abandoned = false
+		return
+	}
+	if h.abandoned {
+		// the card was disconnected meanwhile.
+		h.abandoned = false
+		_ = h.card.EndTransaction(req.Disposition.Scard())
+		return unknownCard(req.Card)
+	}
+	h.transaction = &req.Disposition
+	return nil
+}
 
-	if err = decodeFully(r, &req); err != nil {
+func endTransaction(req *ScardEndTransactionRequest, resp *ScardResponse) (err error) {
+	if !req.Disposition.OK() {
+		return errIncorrectParam
+	}
+	h := lookupCard(req.Ctx, req.Card)
+	if h == nil {
+		return unknownCard(req.Card)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.transaction == nil {
+		return errNotTransacted
+	}
+	if err = h.card.EndTransaction(req.Disposition.Scard()); err != nil {
 		return
 	}
+	h.transaction = nil
+	return nil
+}
 
-	switch req.Method {
-	case "disconnect":
-		if !req.Disposition.OK() {
-			return encodeError("INCORRECT_PARAM", w)
-		}
-		var card *scard.Card
-		if card, err = checkCard(req.Card, w); card == nil {
-			return
-		}
-		if err = card.Disconnect(req.Disposition.Scard()); err != nil {
-			return encodeError(err.Error(), w)
-		}
-		cards[req.Card] = nil
-		resp := ScardResponse{}
-		resp.Error = "0"
-		encoder := json.NewEncoder(w)
-		return encoder.Encode(resp)
-	default:
-		return encodeError(fmt.Sprintf("incorrect method: %s", req.Method), w)
+// abandonTransaction ends a transaction left open by a client with the
+// disposition requested in beginTransaction. A transaction still being
+// begun is ended by beginTransaction once the card is obtained.
+func abandonTransaction(h *handle) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.beginning {
+		h.abandoned = true
+	} else if h.transaction != nil {
+		_ = h.card.EndTransaction(h.transaction.Scard())
+		h.transaction = nil
 	}
 }
 
-func ScardTransmit(r io.Reader, w io.Writer) (err error) {
-	req := ScardTransmitRequest{}
+func transmit(req *ScardTransmitRequest, resp *ScardTransmitResponse) (err error) {
+	if req.Data == "" {
+		return errIncorrectParam
+	}
+	var card BackendCard
+	if card, err = checkCard(req.Ctx, req.Card); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = hex.DecodeString(req.Data); err != nil {
+		return
+	}
+	defer busy(req.Ctx, req.Card)()
+	if data, err = card.Transmit(data); err != nil {
+		return
+	}
+	resp.Data = hex.EncodeToString(data)
+	return nil
+}
 
-	if err = decodeFully(r, &req); err != nil {
+func getStatusChange(req *ScardGetStatusChangeRequest, resp *ScardGetStatusChangeResponse) (err error) {
+	var ctx BackendContext
+	if ctx, err = checkContext(req.Ctx); err != nil {
 		return
 	}
+	if len(req.ReaderStates) == 0 {
+		return errIncorrectParam
+	}
 
-	switch req.Method {
-	case "transmit":
-		if req.Data == "" {
-			return encodeError("INCORRECT_PARAM", w)
+	states := make([]scard.ReaderState, len(req.ReaderStates))
+	for i, rs := range req.ReaderStates {
+		states[i].Reader = rs.Reader
+		states[i].CurrentState = scard.StateFlag(rs.CurrentState)
+		if states[i].Atr, err = hex.DecodeString(rs.ATR); err != nil {
+			return
 		}
+	}
 
-		println(req.Data)
+	// negative timeouts wait forever.
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	defer busy(req.Ctx, "")()
+	if err = ctx.GetStatusChange(states, timeout); err != nil {
+		return
+	}
 
-		var card *scard.Card
-		if card, err = checkCard(req.Card, w); card == nil {
-			return
-		}
-		var data []byte
-		if data, err = hex.DecodeString(req.Data); err != nil {
-			return encodeError(err.Error(), w)
-		}
-		if data, err = card.Transmit(data); err != nil {
-			return encodeError(err.Error(), w)
-		}
-		resp := ScardTransmitResponse{}
-		resp.Error = "0"
-		resp.Data = hex.EncodeToString(data)
-		encoder := json.NewEncoder(w)
-		return encoder.Encode(resp)
-	default:
-		return encodeError(fmt.Sprintf("incorrect method: %s", req.Method), w)
+	resp.ReaderStates = make([]ReaderState, len(states))
+	for i, rs := range states {
+		resp.ReaderStates[i].Reader = rs.Reader
+		resp.ReaderStates[i].CurrentState = uint32(rs.CurrentState)
+		resp.ReaderStates[i].EventState = uint32(rs.EventState)
+		resp.ReaderStates[i].ATR = hex.EncodeToString(rs.Atr)
 	}
+	return nil
 }
 
-// // cancel
-// // reconnect
-// {}
-// // transmit
+func reconnect(req *ScardReconnectRequest, resp *ScardReconnectResponse) (err error) {
+	if !req.Protocol.OK() || !req.ShareMode.OK() || !req.Disposition.OK() {
+		return errIncorrectParam
+	}
+	var card BackendCard
+	if card, err = checkCard(req.Ctx, req.Card); err != nil {
+		return
+	}
+	if err = card.Reconnect(req.ShareMode.Scard(), req.Protocol.Scard(), req.Disposition.Scard()); err != nil {
+		return
+	}
+	// Reconnect doesn't report the negotiated protocol, ask for it.
+	var status *scard.CardStatus
+	if status, err = card.Status(); err != nil {
+		return
+	}
+	resp.Card = req.Card
+	resp.ActiveProtocol = ProtocolFromScard(status.ActiveProtocol)
+	return nil
+}
+
+// control sends a command directly to the reader (e.g. CCID escape
+// commands or GET_FEATURE_REQUEST), input may be empty.
+func control(req *ScardControlRequest, resp *ScardControlResponse) (err error) {
+	var card BackendCard
+	if card, err = checkCard(req.Ctx, req.Card); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = hex.DecodeString(req.Data); err != nil {
+		return
+	}
+	defer busy(req.Ctx, req.Card)()
+	if data, err = card.Control(req.ControlCode, data); err != nil {
+		return
+	}
+	resp.Card = req.Card
+	resp.Data = hex.EncodeToString(data)
+	return nil
+}
+
+// getAttrib returns the raw attribute value as hex, well known string and
+// integer attributes are additionally decoded into "value".
+func getAttrib(req *ScardGetAttribRequest, resp *ScardGetAttribResponse) (err error) {
+	var card BackendCard
+	if card, err = checkCard(req.Ctx, req.Card); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = card.GetAttrib(req.AttrId.Scard()); err != nil {
+		return
+	}
+	resp.Card = req.Card
+	resp.AttrId = req.AttrId
+	resp.Data = hex.EncodeToString(data)
+	resp.Value = req.AttrId.Decode(data)
+	return nil
+}
+
+func setAttrib(req *ScardSetAttribRequest, resp *ScardResponse) (err error) {
+	var card BackendCard
+	if card, err = checkCard(req.Ctx, req.Card); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = hex.DecodeString(req.Data); err != nil {
+		return
+	}
+	return card.SetAttrib(req.AttrId.Scard(), data)
+}
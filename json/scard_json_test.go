@@ -3,13 +3,42 @@ package json
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 import "github.com/ebfe/go.pcsclite/scard"
 
+// The tests run against a virtual reader containing a card that knows
+// SELECT PSE and SELECT MF, see backend_virtual.go.
+var virtual = NewVirtualBackend()
+var virtualReader = virtual.AddReader("Virtual Reader 0")
+
+var testATR = []byte{0x3B, 0x8F, 0x80, 0x01, 0x80, 0x4F, 0x0C, 0xA0, 0x00, 0x00, 0x03, 0x06, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x6A}
+
+func newTestCard() *VirtualCard {
+	return NewVirtualCard(testATR, Script(map[string]string{
+		// SELECT 1PAY.SYS.DDF01
+		"00A404000E315041592E5359532E444446303100": "6F 15 84 0E 315041592E5359532E4444463031 A5 03 88 01 01 9000",
+		// SELECT MF
+		"00A40000023F00": "9000",
+	}))
+}
+
+func init() {
+	virtualReader.Insert(newTestCard())
+	virtualReader.SetControl(func(code uint32, in []byte) ([]byte, error) {
+		// no features
+		return []byte{}, nil
+	})
+	SetBackend(virtual)
+}
+
 func TestVersion(t *testing.T) {
 	req := `{
 	"method": "version"
@@ -24,7 +53,7 @@ func TestVersion(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fail()
 		} else {
-			if resp.Version != "1.7.4" {
+			if resp.Version != VIRTUAL_VERSION {
 				println(resp.Version)
 				t.Fail()
 			}
@@ -37,7 +66,7 @@ func TestCtx(t *testing.T) {
 		t.Fail()
 	} else {
 		t.Log(ctx)
-		_ = contexts[ctx].Release()
+		_ = contextFor(ctx).Release()
 	}
 }
 
@@ -82,11 +111,11 @@ func TestRelease(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fail()
 		} else {
-			if resp.Error != "0" {
+			if resp.Error != nil {
 				t.Logf("unexpected error: %s", resp.Error)
 				t.FailNow()
 			}
-			if contexts[ctx] != nil {
+			if contexts.lookup(string(ctx)) != nil {
 				t.Errorf("context still stored after release")
 			}
 		}
@@ -117,13 +146,13 @@ func TestValid(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fail()
 		} else {
-			if resp.Error != "0" {
+			if resp.Error != nil {
 				t.Logf("unexpected error: %s", resp.Error)
 				t.FailNow()
 			}
 		}
 	}
-	contexts[ctx].Release()
+	contextFor(ctx).Release()
 	// check again with released context
 
 	reader = strings.NewReader(req)
@@ -135,7 +164,7 @@ func TestValid(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fail()
 		} else {
-			if resp.Error != "INVALID_HANDLE" {
+			if !resp.Error.HasCode(scard.E_INVALID_HANDLE) {
 				t.Logf("unexpected error: %s", resp.Error)
 				t.FailNow()
 			}
@@ -168,7 +197,7 @@ func TestListReaders(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fail()
 		} else {
-			if resp.Error != "0" {
+			if resp.Error != nil {
 				t.Logf("unexpected error: %s", resp.Error)
 				t.FailNow()
 			}
@@ -178,7 +207,7 @@ func TestListReaders(t *testing.T) {
 			}
 		}
 	}
-	contexts[ctx].Release()
+	contextFor(ctx).Release()
 	// check again with released context
 
 	reader = strings.NewReader(req)
@@ -190,7 +219,7 @@ func TestListReaders(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fail()
 		} else {
-			if resp.Error != "INVALID_HANDLE" {
+			if !resp.Error.HasCode(scard.E_INVALID_HANDLE) {
 				t.Logf("unexpected error: %s", resp.Error)
 				t.FailNow()
 			}
@@ -201,14 +230,14 @@ func TestListReaders(t *testing.T) {
 
 func TestConnect(t *testing.T) {
 	var reader string
-	if ctx, err := scard.EstablishContext(); err != nil {
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
 		t.Fatal(err)
 	} else {
 		defer ctx.Release()
 		if rdrs, err := ctx.ListReaders(); err != nil {
 			t.Fatal(err)
 		} else {
-			contexts["123"] = ctx
+			contexts.insert("123", &handle{ctx: ctx})
 			reader = rdrs[0]
 		}
 	}
@@ -232,19 +261,19 @@ func TestConnect(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fatal(err)
 		} else {
-			if resp.Error != "0" {
+			if resp.Error != nil {
 				t.Logf("unexpected error: %s", resp.Error)
 				t.FailNow()
 			}
 			t.Logf("card: %s\n", resp.Card)
-			if cards[resp.Card] == nil {
+			if cards.lookup(string(resp.Card)) == nil {
 				t.Error("card not in server")
 			}
-			if err = cards[resp.Card].Disconnect(scard.UNPOWER_CARD); err != nil {
+			if err = cards.lookup(string(resp.Card)).card.Disconnect(scard.UNPOWER_CARD); err != nil {
 				t.Fatal(err)
 			} else {
 			}
-			cards[resp.Card] = nil
+			cards.remove(string(resp.Card))
 		}
 	}
 
@@ -252,31 +281,31 @@ func TestConnect(t *testing.T) {
 
 func TestStatus(t *testing.T) {
 	var reader string
-	if ctx, err := scard.EstablishContext(); err != nil {
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
 		t.Fatal(err)
 	} else {
 		defer ctx.Release()
 		if rdrs, err := ctx.ListReaders(); err != nil {
 			t.Fatal(err)
 		} else {
-			contexts["123"] = ctx
+			contexts.insert("123", &handle{ctx: ctx})
 			reader = rdrs[0]
 		}
 	}
 
-	var card *scard.Card
+	var card BackendCard
 	var err error
-	if card, err = contexts["123"].Connect(reader, scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY); err != nil {
+	if card, err = contextFor("123").Connect(reader, scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY); err != nil {
 		t.Fatal(err)
 	}
 
-	cards[Card("123")] = card
+	cards.insert("123", &handle{card: card, parent: "123"})
 	req := `{
 			"method":"status",
+			"ctx":"123",
 			"card":"123"
 		}`
 
-	req = fmt.Sprintf(req, reader)
 	rder := strings.NewReader(req)
 	writer := &bytes.Buffer{}
 
@@ -287,21 +316,21 @@ func TestStatus(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fatal(err)
 		} else {
-			if resp.Error != "0" {
+			if resp.Error != nil {
 				t.Logf("unexpected error: %s", resp.Error)
 				t.FailNow()
 			}
 			t.Logf("card: %s\n", resp.Card)
 			t.Logf("reader: %s (%s)\n", resp.Reader, reader)
-			t.Logf("state: %s\n", resp.State)
+			t.Logf("state: %x\n", resp.State)
 			t.Logf("proto: %s\n", resp.ActiveProtocol)
 			t.Logf("atr: %s\n", resp.ATR)
 
-			if cards[resp.Card] == nil {
+			if cards.lookup(string(resp.Card)) == nil {
 				t.Error("card not in server")
 			}
-			cards[resp.Card].Disconnect(scard.UNPOWER_CARD)
-			cards[resp.Card] = nil
+			cards.lookup(string(resp.Card)).card.Disconnect(scard.UNPOWER_CARD)
+			cards.remove(string(resp.Card))
 		}
 	}
 
@@ -309,33 +338,33 @@ func TestStatus(t *testing.T) {
 
 func TestDisconnect(t *testing.T) {
 	var reader string
-	if ctx, err := scard.EstablishContext(); err != nil {
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
 		t.Fatal(err)
 	} else {
 		defer ctx.Release()
 		if rdrs, err := ctx.ListReaders(); err != nil {
 			t.Fatal(err)
 		} else {
-			contexts["123"] = ctx
+			contexts.insert("123", &handle{ctx: ctx})
 			reader = rdrs[0]
 		}
 	}
 
-	var card *scard.Card
+	var card BackendCard
 	var err error
-	if card, err = contexts["123"].Connect(reader, scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY); err != nil {
+	if card, err = contextFor("123").Connect(reader, scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY); err != nil {
 		t.Fatal(err)
 	}
 
-	cards[Card("123")] = card
+	cards.insert("123", &handle{card: card, parent: "123"})
 
 	req := `{
 		"method":"disconnect",
+		"ctx":"123",
 		"card":"123",
 		"disposition":"UNPOWER_CARD"
 	}`
 
-	req = fmt.Sprintf(req, reader)
 	rder := strings.NewReader(req)
 	writer := &bytes.Buffer{}
 
@@ -346,10 +375,10 @@ func TestDisconnect(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fatal(err)
 		} else {
-			if resp.Error != "0" {
+			if resp.Error != nil {
 				t.Fatalf("unexpected error: %s", resp.Error)
 			}
-			if cards["123"] != nil {
+			if cards.lookup("123") != nil {
 				t.Fatal("card still in server")
 			}
 		}
@@ -358,21 +387,21 @@ func TestDisconnect(t *testing.T) {
 
 func TestTransmit(t *testing.T) {
 	var reader string
-	if ctx, err := scard.EstablishContext(); err != nil {
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
 		t.Fatal(err)
 	} else {
 		defer ctx.Release()
 		if rdrs, err := ctx.ListReaders(); err != nil {
 			t.Fatal(err)
 		} else {
-			contexts["123"] = ctx
+			contexts.insert("123", &handle{ctx: ctx})
 			reader = rdrs[0]
 		}
 	}
 
-	var card *scard.Card
+	var card BackendCard
 	var err error
-	if card, err = contexts["123"].Connect(reader, scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY); err != nil {
+	if card, err = contextFor("123").Connect(reader, scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY); err != nil {
 		t.Fatal(err)
 	}
 	// currently stupid workaround so SCM SCR 3310 will work
@@ -381,7 +410,7 @@ func TestTransmit(t *testing.T) {
 	if err = card.Reconnect(scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY, scard.RESET_CARD); err != nil {
 		t.Fatal(err)
 	}
-	cards[Card("123")] = card
+	cards.insert("123", &handle{card: card, parent: "123"})
 	defer card.Disconnect(scard.UNPOWER_CARD)
 
 	// use any old credit card to test
@@ -392,6 +421,7 @@ func TestTransmit(t *testing.T) {
 
 	req := `{
 		"method":"transmit",
+		"ctx":"123",
 		"card":"123",
 		"data":"%s"
 	}`
@@ -409,7 +439,7 @@ func TestTransmit(t *testing.T) {
 		if err = decodeFully(writer, &resp); err != nil {
 			t.Fatal(err)
 		} else {
-			if resp.Error != "0" {
+			if resp.Error != nil {
 				t.Fatalf("unexpected error: %s", resp.Error)
 			}
 			t.Logf("response: %s", resp.Data)
@@ -418,6 +448,852 @@ func TestTransmit(t *testing.T) {
 	if err = card.EndTransaction(scard.LEAVE_CARD); err != nil {
 		t.Fatal(err)
 	}
-	contexts["123"] = nil
-	cards[Card("123")] = nil
+	contexts.remove("123")
+	cards.remove("123")
+}
+
+func TestGetStatusChange(t *testing.T) {
+	var reader string
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
+		t.Fatal(err)
+	} else {
+		defer ctx.Release()
+		if rdrs, err := ctx.ListReaders(); err != nil {
+			t.Fatal(err)
+		} else {
+			contexts.insert("123", &handle{ctx: ctx})
+			reader = rdrs[0]
+		}
+	}
+
+	// current state UNAWARE (0) returns the reader's state immediately.
+	req := `{
+		"method":"getStatusChange",
+		"ctx":"123",
+		"timeout": 1000,
+		"readerStates": [{"reader":"%s", "currentState": 0}]
+	}`
+
+	req = fmt.Sprintf(req, reader)
+	rder := strings.NewReader(req)
+	writer := &bytes.Buffer{}
+
+	if err := ScardJson(rder, writer); err != nil {
+		t.Fatal(err)
+	} else {
+		resp := ScardGetStatusChangeResponse{}
+		if err = decodeFully(writer, &resp); err != nil {
+			t.Fatal(err)
+		} else {
+			if resp.Error != nil {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if len(resp.ReaderStates) != 1 {
+				t.Fatalf("expected 1 reader state, got %d", len(resp.ReaderStates))
+			}
+			t.Logf("eventState: %x\n", resp.ReaderStates[0].EventState)
+			t.Logf("atr: %s\n", resp.ReaderStates[0].ATR)
+		}
+	}
+	contexts.remove("123")
+}
+
+func TestReconnect(t *testing.T) {
+	var reader string
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
+		t.Fatal(err)
+	} else {
+		defer ctx.Release()
+		if rdrs, err := ctx.ListReaders(); err != nil {
+			t.Fatal(err)
+		} else {
+			contexts.insert("123", &handle{ctx: ctx})
+			reader = rdrs[0]
+		}
+	}
+
+	var card BackendCard
+	var err error
+	if card, err = contextFor("123").Connect(reader, scard.SHARE_EXCLUSIVE, scard.PROTOCOL_ANY); err != nil {
+		t.Fatal(err)
+	}
+	cards.insert("123", &handle{card: card, parent: "123"})
+	defer card.Disconnect(scard.UNPOWER_CARD)
+
+	req := `{
+		"method":"reconnect",
+		"ctx":"123",
+		"card":"123",
+		"shareMode":"EXCLUSIVE",
+		"protocol":"ANY",
+		"disposition":"RESET_CARD"
+	}`
+
+	rder := strings.NewReader(req)
+	writer := &bytes.Buffer{}
+
+	if err := ScardJson(rder, writer); err != nil {
+		t.Fatal(err)
+	} else {
+		resp := ScardReconnectResponse{}
+		if err = decodeFully(writer, &resp); err != nil {
+			t.Fatal(err)
+		} else {
+			if resp.Error != nil {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if resp.Card != "123" {
+				t.Errorf("card token changed: %s", resp.Card)
+			}
+			if cards.lookup(string(resp.Card)).card != card {
+				t.Error("card not in server")
+			}
+			t.Logf("proto: %s\n", resp.ActiveProtocol)
+		}
+	}
+	contexts.remove("123")
+	cards.remove("123")
+}
+
+func TestCancel(t *testing.T) {
+	var reader string
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
+		t.Fatal(err)
+	} else {
+		defer ctx.Release()
+		if rdrs, err := ctx.ListReaders(); err != nil {
+			t.Fatal(err)
+		} else {
+			contexts.insert("123", &handle{ctx: ctx})
+			reader = rdrs[0]
+		}
+	}
+
+	// figure out the current state so the next call blocks.
+	states := []scard.ReaderState{{Reader: reader}}
+	if err := contextFor("123").GetStatusChange(states, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	req := `{
+		"method":"getStatusChange",
+		"ctx":"123",
+		"timeout": -1,
+		"readerStates": [{"reader":"%s", "currentState": %d}]
+	}`
+	req = fmt.Sprintf(req, reader, states[0].EventState)
+
+	done := make(chan ScardGetStatusChangeResponse)
+	go func() {
+		writer := &bytes.Buffer{}
+		resp := ScardGetStatusChangeResponse{}
+		if err := ScardJson(strings.NewReader(req), writer); err != nil {
+			t.Error(err)
+		} else if err = decodeFully(writer, &resp); err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	cancel := `{
+		"method":"cancel",
+		"ctx":"123"
+	}`
+	writer := &bytes.Buffer{}
+	if err := ScardJson(strings.NewReader(cancel), writer); err != nil {
+		t.Fatal(err)
+	} else {
+		resp := ScardResponse{}
+		if err = decodeFully(writer, &resp); err != nil {
+			t.Fatal(err)
+		} else if resp.Error != nil {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+	}
+
+	select {
+	case resp := <-done:
+		if !resp.Error.HasCode(scard.E_CANCELLED) {
+			t.Fatalf("unexpected error: %s", resp.Error)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("getStatusChange not cancelled")
+	}
+	contexts.remove("123")
+}
+
+func TestTransaction(t *testing.T) {
+	var reader string
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
+		t.Fatal(err)
+	} else {
+		defer ctx.Release()
+		if rdrs, err := ctx.ListReaders(); err != nil {
+			t.Fatal(err)
+		} else {
+			contexts.insert("123", &handle{ctx: ctx})
+			reader = rdrs[0]
+		}
+	}
+
+	var card BackendCard
+	var err error
+	if card, err = contextFor("123").Connect(reader, scard.SHARE_SHARED, scard.PROTOCOL_ANY); err != nil {
+		t.Fatal(err)
+	}
+	cards.insert("123", &handle{card: card, parent: "123"})
+	defer card.Disconnect(scard.LEAVE_CARD)
+
+	call := func(req string) ScardResponse {
+		writer := &bytes.Buffer{}
+		resp := ScardResponse{}
+		if err := ScardJson(strings.NewReader(req), writer); err != nil {
+			t.Fatal(err)
+		} else if err = decodeFully(writer, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	begin := `{
+		"method":"beginTransaction",
+		"ctx":"123",
+		"card":"123",
+		"disposition":"RESET_CARD"
+	}`
+	end := `{
+		"method":"endTransaction",
+		"ctx":"123",
+		"card":"123",
+		"disposition":"LEAVE_CARD"
+	}`
+
+	if resp := call(begin); resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if h := cards.lookup("123"); h.transaction == nil || *h.transaction != RESET_CARD {
+		t.Errorf("transaction not tracked: %v", h.transaction)
+	}
+	if resp := call(begin); !resp.Error.HasCode(scard.E_INVALID_VALUE) {
+		t.Errorf("unexpected error: %s", resp.Error)
+	}
+	if resp := call(end); resp.Error != nil {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if cards.lookup("123").transaction != nil {
+		t.Error("transaction still tracked")
+	}
+	if resp := call(end); !resp.Error.HasCode(scard.E_NOT_TRANSACTED) {
+		t.Errorf("unexpected error: %s", resp.Error)
+	}
+	contexts.remove("123")
+	cards.remove("123")
+}
+
+func TestTransactionWaitingRelease(t *testing.T) {
+	connect := func() (Context, Card) {
+		ctx, err := getContext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := ScardConnectResponse{}
+		virtualCall(t, fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, virtualReader.Name), &resp)
+		if resp.Error != nil {
+			t.Fatalf("connect: %s", resp.Error)
+		}
+		return ctx, resp.Card
+	}
+	begin := `{"method":"beginTransaction", "ctx":"%s", "card":"%s"}`
+
+	ctxA, cardA := connect()
+	defer releaseContext(ctxA, LEAVE_CARD)
+	resp := ScardResponse{}
+	if virtualCall(t, fmt.Sprintf(begin, ctxA, cardA), &resp); resp.Error != nil {
+		t.Fatalf("beginTransaction: %s", resp.Error)
+	}
+
+	// B waits for A's transaction, releasing B doesn't.
+	ctxB, cardB := connect()
+	h := cards.lookup(string(cardB))
+	began := make(chan *ScardError)
+	go func() {
+		resp := ScardResponse{}
+		virtualCall(t, fmt.Sprintf(begin, ctxB, cardB), &resp)
+		began <- resp.Error
+	}()
+	for i := 0; ; i++ {
+		h.lock.Lock()
+		beginning := h.beginning
+		h.lock.Unlock()
+		if beginning {
+			break
+		} else if i == 50 {
+			t.Fatal("beginTransaction not waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	released := make(chan bool)
+	go func() {
+		virtualCall(t, fmt.Sprintf(`{"method":"releaseContext", "ctx":"%s"}`, ctxB), &ScardResponse{})
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("releaseContext blocked by waiting beginTransaction")
+	}
+	select {
+	case e := <-began:
+		if e == nil {
+			t.Error("transaction begun on released card")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("beginTransaction still waiting")
+	}
+
+	if virtualCall(t, fmt.Sprintf(`{"method":"endTransaction", "ctx":"%s", "card":"%s", "disposition":"LEAVE_CARD"}`, ctxA, cardA), &resp); resp.Error != nil {
+		t.Errorf("endTransaction: %s", resp.Error)
+	}
+}
+
+func TestControl(t *testing.T) {
+	var reader string
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
+		t.Fatal(err)
+	} else {
+		defer ctx.Release()
+		if rdrs, err := ctx.ListReaders(); err != nil {
+			t.Fatal(err)
+		} else {
+			contexts.insert("123", &handle{ctx: ctx})
+			reader = rdrs[0]
+		}
+	}
+
+	var card BackendCard
+	var err error
+	if card, err = contextFor("123").Connect(reader, scard.SHARE_DIRECT, scard.PROTOCOL_UNDEFINED); err != nil {
+		t.Fatal(err)
+	}
+	cards.insert("123", &handle{card: card, parent: "123"})
+	defer card.Disconnect(scard.LEAVE_CARD)
+
+	// CM_IOCTL_GET_FEATURE_REQUEST, SCARD_CTL_CODE(3400) on pcsc-lite
+	req := `{
+		"method":"control",
+		"ctx":"123",
+		"card":"123",
+		"controlCode": %d,
+		"data":""
+	}`
+	req = fmt.Sprintf(req, 0x42000000+3400)
+	rder := strings.NewReader(req)
+	writer := &bytes.Buffer{}
+
+	if err := ScardJson(rder, writer); err != nil {
+		t.Fatal(err)
+	} else {
+		resp := ScardControlResponse{}
+		if err = decodeFully(writer, &resp); err != nil {
+			t.Fatal(err)
+		} else {
+			if resp.Error != nil {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			t.Logf("features: %s", resp.Data)
+		}
+	}
+	contexts.remove("123")
+	cards.remove("123")
+}
+
+func TestGetAttrib(t *testing.T) {
+	var reader string
+	if ctx, err := DefaultBackend().EstablishContext(); err != nil {
+		t.Fatal(err)
+	} else {
+		defer ctx.Release()
+		if rdrs, err := ctx.ListReaders(); err != nil {
+			t.Fatal(err)
+		} else {
+			contexts.insert("123", &handle{ctx: ctx})
+			reader = rdrs[0]
+		}
+	}
+
+	var card BackendCard
+	var err error
+	if card, err = contextFor("123").Connect(reader, scard.SHARE_DIRECT, scard.PROTOCOL_UNDEFINED); err != nil {
+		t.Fatal(err)
+	}
+	cards.insert("123", &handle{card: card, parent: "123"})
+	defer card.Disconnect(scard.LEAVE_CARD)
+
+	// symbolic and numeric ids must refer to the same attribute.
+	for _, attrId := range []string{`"SCARD_ATTR_VENDOR_NAME"`, `"ATTR_VENDOR_NAME"`, `65792`} {
+		req := `{
+			"method":"getAttrib",
+			"ctx":"123",
+			"card":"123",
+			"attrId": %s
+		}`
+		req = fmt.Sprintf(req, attrId)
+		writer := &bytes.Buffer{}
+
+		if err := ScardJson(strings.NewReader(req), writer); err != nil {
+			t.Fatal(err)
+		} else {
+			resp := ScardGetAttribResponse{}
+			if err = decodeFully(writer, &resp); err != nil {
+				t.Fatal(err)
+			} else {
+				if resp.Error != nil {
+					t.Fatalf("unexpected error: %s", resp.Error)
+				}
+				if resp.AttrId != ATTR_VENDOR_NAME {
+					t.Errorf("unexpected attribute: %s", resp.AttrId)
+				}
+				if _, ok := resp.Value.(string); !ok {
+					t.Errorf("vendor name not decoded: %v", resp.Value)
+				}
+				t.Logf("vendor: %s (%v)", resp.Data, resp.Value)
+			}
+		}
+	}
+	contexts.remove("123")
+	cards.remove("123")
+}
+
+func TestMergeReaderGroups(t *testing.T) {
+	for _, group := range []string{"signing", "kiosk", "audit"} {
+		DefineReaderGroup(group, "NO SUCH READER")
+		defer RemoveReaderGroup(group)
+	}
+	groups := mergeReaderGroups([]string{"SCard$DefaultReaders", "kiosk"})
+	if strings.Join(groups, ",") != "SCard$DefaultReaders,kiosk,audit,signing" {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+}
+
+func TestListReaderGroups(t *testing.T) {
+	var ctx Context
+	var err error
+
+	if ctx, err = getContext(); err != nil {
+		t.Fatalf("couldn't get initial ctx: %s", err.Error())
+	}
+	defer contextFor(ctx).Release()
+
+	DefineReaderGroup("signing", "NO SUCH READER")
+	defer RemoveReaderGroup("signing")
+
+	req := `{
+	"method": "listReaderGroups",
+	"ctx": "%s"
+	}`
+	req = fmt.Sprintf(req, ctx)
+	writer := &bytes.Buffer{}
+
+	if err := ScardJson(strings.NewReader(req), writer); err != nil {
+		t.Fatal(err)
+	} else {
+		resp := ScardListReaderGroupsResponse{}
+		if err = decodeFully(writer, &resp); err != nil {
+			t.Fatal(err)
+		} else {
+			if resp.Error != nil {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if !contains(resp.Groups, "signing") {
+				t.Errorf("server side group missing: %v", resp.Groups)
+			}
+		}
+	}
+
+	req = `{
+	"method": "listReaders",
+	"ctx": "%s",
+	"groups": ["signing"]
+	}`
+	req = fmt.Sprintf(req, ctx)
+	writer = &bytes.Buffer{}
+
+	if err := ScardJson(strings.NewReader(req), writer); err != nil {
+		t.Fatal(err)
+	} else {
+		resp := ScardListReadersResponse{}
+		if err = decodeFully(writer, &resp); err != nil {
+			t.Fatal(err)
+		} else {
+			if resp.Error != nil {
+				t.Fatalf("unexpected error: %s", resp.Error)
+			}
+			if len(resp.Readers) != 0 {
+				t.Errorf("expected no readers, got: %v", resp.Readers)
+			}
+		}
+	}
+}
+
+func TestFilterReaders(t *testing.T) {
+	DefineReaderGroup("signing", "Reader A", "Reader C")
+	DefineReaderGroup("kiosk", "Reader B")
+	defer RemoveReaderGroup("signing")
+	defer RemoveReaderGroup("kiosk")
+
+	readers := []string{"Reader A 00 00", "Reader B 00 00", "Reader C 00 00"}
+	pcsc := []string{"SCard$DefaultReaders"}
+
+	tests := []struct {
+		groups   []string
+		expected []string
+	}{
+		{[]string{"signing"}, []string{"Reader A 00 00", "Reader C 00 00"}},
+		{[]string{"kiosk"}, []string{"Reader B 00 00"}},
+		{[]string{"signing", "kiosk"}, readers},
+		{[]string{"SCard$DefaultReaders"}, readers},
+		{[]string{"unknown"}, []string{}},
+	}
+
+	for _, test := range tests {
+		filtered := filterReaders(readers, pcsc, test.groups)
+		if fmt.Sprint(filtered) != fmt.Sprint(test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.groups, test.expected, filtered)
+		}
+	}
+}
+
+// run with -race, hammers the registries from parallel requests.
+func TestConcurrentCards(t *testing.T) {
+	var ctx Context
+	var err error
+
+	if ctx, err = getContext(); err != nil {
+		t.Fatalf("couldn't get initial ctx: %s", err.Error())
+	}
+	defer contextFor(ctx).Release()
+
+	var reader string
+	if rdrs, err := contextFor(ctx).ListReaders(); err != nil {
+		t.Fatal(err)
+	} else {
+		reader = rdrs[0]
+	}
+
+	call := func(req string, resp interface{}) {
+		writer := &bytes.Buffer{}
+		if err := ScardJson(strings.NewReader(req), writer); err != nil {
+			t.Error(err)
+		} else if err = decodeFully(writer, resp); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// SELECT MF
+	apdu := "00A40000023F00"
+	wg := sync.WaitGroup{}
+	for i := 0; i != 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j != 10; j++ {
+				connect := ScardConnectResponse{}
+				call(fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, reader), &connect)
+				if connect.Error != nil {
+					t.Errorf("connect: %s", connect.Error)
+					return
+				}
+				transmit := ScardTransmitResponse{}
+				call(fmt.Sprintf(`{"method":"transmit", "ctx":"%s", "card":"%s", "data":"%s"}`, ctx, connect.Card, apdu), &transmit)
+				if transmit.Error != nil {
+					t.Errorf("transmit: %s", transmit.Error)
+				}
+				disconnect := ScardResponse{}
+				call(fmt.Sprintf(`{"method":"disconnect", "ctx":"%s", "card":"%s", "disposition":"LEAVE_CARD"}`, ctx, connect.Card), &disconnect)
+				if disconnect.Error != nil {
+					t.Errorf("disconnect: %s", disconnect.Error)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGenToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i != 1000; i++ {
+		tok, err := genToken(CARD_PREFIX)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(tok, CARD_PREFIX) {
+			t.Fatalf("missing prefix: %s", tok)
+		}
+		if seen[tok] {
+			t.Fatalf("duplicate token: %s", tok)
+		}
+		seen[tok] = true
+	}
+}
+
+func TestCardBoundToContext(t *testing.T) {
+	cards.insert("card_test", &handle{parent: "ctx_owner"})
+	defer cards.remove("card_test")
+
+	for _, ctx := range []string{"ctx_other", ""} {
+		req := `{
+			"method":"status",
+			"ctx":"%s",
+			"card":"card_test"
+		}`
+		req = fmt.Sprintf(req, ctx)
+		writer := &bytes.Buffer{}
+
+		if err := ScardJson(strings.NewReader(req), writer); err != nil {
+			t.Fatal(err)
+		} else {
+			resp := ScardStatusResponse{}
+			if err = decodeFully(writer, &resp); err != nil {
+				t.Fatal(err)
+			} else if resp.Error == nil || *resp.Error != *errUnknownCard {
+				t.Errorf("ctx %q: unexpected error: %s", ctx, resp.Error)
+			}
+		}
+	}
+}
+
+func TestReleaseCascade(t *testing.T) {
+	var ctx Context
+	var err error
+
+	if ctx, err = getContext(); err != nil {
+		t.Fatalf("couldn't get initial ctx: %s", err.Error())
+	}
+
+	var reader string
+	if rdrs, err := contextFor(ctx).ListReaders(); err != nil {
+		t.Fatal(err)
+	} else {
+		reader = rdrs[0]
+	}
+
+	call := func(req string, resp interface{}) {
+		writer := &bytes.Buffer{}
+		if err := ScardJson(strings.NewReader(req), writer); err != nil {
+			t.Fatal(err)
+		} else if err = decodeFully(writer, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connect := ScardConnectResponse{}
+	call(fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"SHARED", "protocol":"ANY"}`, ctx, reader), &connect)
+	if connect.Error != nil {
+		t.Fatalf("connect: %s", connect.Error)
+	}
+	if h := cards.lookup(string(connect.Card)); h == nil || h.parent != ctx {
+		t.Fatal("card not registered with its context")
+	}
+
+	release := ScardResponse{}
+	call(fmt.Sprintf(`{"method":"releaseContext", "ctx":"%s", "disposition":"LEAVE_CARD"}`, ctx), &release)
+	if release.Error != nil {
+		t.Fatalf("release: %s", release.Error)
+	}
+	if cards.lookup(string(connect.Card)) != nil {
+		t.Error("card still registered after releasing its context")
+	}
+	if contexts.lookup(string(ctx)) != nil {
+		t.Error("context still registered after release")
+	}
+}
+
+func TestReaper(t *testing.T) {
+	var ctx Context
+	var err error
+
+	if ctx, err = getContext(); err != nil {
+		t.Fatalf("couldn't get initial ctx: %s", err.Error())
+	}
+
+	var reader string
+	if rdrs, err := contextFor(ctx).ListReaders(); err != nil {
+		t.Fatal(err)
+	} else {
+		reader = rdrs[0]
+	}
+
+	call := func(req string, resp interface{}) {
+		writer := &bytes.Buffer{}
+		if err := ScardJson(strings.NewReader(req), writer); err != nil {
+			t.Fatal(err)
+		} else if err = decodeFully(writer, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connect := ScardConnectResponse{}
+	call(fmt.Sprintf(`{"method":"connect", "ctx":"%s", "reader":"%s", "shareMode":"EXCLUSIVE", "protocol":"ANY"}`, ctx, reader), &connect)
+	if connect.Error != nil {
+		t.Fatalf("connect: %s", connect.Error)
+	}
+
+	// pretend a minute passed, only the card is reaped.
+	defer func(c, k time.Duration) { ContextIdleTimeout, CardIdleTimeout = c, k }(ContextIdleTimeout, CardIdleTimeout)
+	ContextIdleTimeout, CardIdleTimeout = time.Hour, time.Second
+	reap(time.Now().Add(time.Minute))
+
+	status := ScardStatusResponse{}
+	call(fmt.Sprintf(`{"method":"status", "ctx":"%s", "card":"%s"}`, ctx, connect.Card), &status)
+	if status.Error == nil || status.Error.Category != CATEGORY_EXPIRED {
+		t.Errorf("unexpected error: %s", status.Error)
+	}
+
+	ContextIdleTimeout = time.Second
+	reap(time.Now().Add(time.Minute))
+
+	list := ScardListReadersResponse{}
+	call(fmt.Sprintf(`{"method":"listReaders", "ctx":"%s"}`, ctx), &list)
+	if list.Error == nil || list.Error.Category != CATEGORY_EXPIRED {
+		t.Errorf("unexpected error: %s", list.Error)
+	}
+}
+
+type versionBackend string
+
+func (v versionBackend) Version() string {
+	return string(v)
+}
+
+func (v versionBackend) EstablishContext() (BackendContext, error) {
+	return nil, scard.E_NO_SERVICE
+}
+
+func TestSetBackend(t *testing.T) {
+	defer SetBackend(DefaultBackend())
+	SetBackend(versionBackend("test"))
+
+	writer := &bytes.Buffer{}
+	if err := ScardJson(strings.NewReader(`{"method":"version"}`), writer); err != nil {
+		t.Fatal(err)
+	}
+	resp := ScardVersionResponse{}
+	if err := decodeFully(writer, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Version != "test" {
+		t.Errorf("backend not used, version: %s", resp.Version)
+	}
+
+	writer = &bytes.Buffer{}
+	if err := ScardJson(strings.NewReader(`{"method":"establishContext"}`), writer); err != nil {
+		t.Fatal(err)
+	}
+	ctxResp := ScardContextResponse{}
+	if err := decodeFully(writer, &ctxResp); err != nil {
+		t.Fatal(err)
+	}
+	if ctxResp.Error == nil || ctxResp.Ctx != "" {
+		t.Errorf("expected backend error, got ctx %q", ctxResp.Ctx)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestMalformedRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      string
+		category ErrorCategory
+	}{
+		{"empty", ``, CATEGORY_PARSE_ERROR},
+		{"garbage", `garbage`, CATEGORY_PARSE_ERROR},
+		{"truncated", `{"method":"version"`, CATEGORY_PARSE_ERROR},
+		{"string", `"version"`, CATEGORY_PARSE_ERROR},
+		{"trailing garbage", `{"method":"version"} xyz`, CATEGORY_PARSE_ERROR},
+		{"second request", `{"method":"version"}{"method":"establishContext"}`, CATEGORY_PARSE_ERROR},
+		{"unknown field", `{"method":"version", "ctx":"ctx_00"}`, CATEGORY_PARSE_ERROR},
+		{"unknown card field", `{"method":"transmit", "ctx":"ctx_00", "card":"card_00", "apdu":"00A4"}`, CATEGORY_PARSE_ERROR},
+		{"wrong type", `{"method":"getStatusChange", "ctx":"ctx_00", "timeout":"soon", "readerStates":[]}`, CATEGORY_PARSE_ERROR},
+		{"unknown attribute", `{"method":"getAttrib", "ctx":"ctx_00", "card":"card_00", "attrId":"NO_SUCH_ATTR"}`, CATEGORY_PARSE_ERROR},
+		{"unknown method", `{"method":"nonsense"}`, CATEGORY_UNKNOWN_METHOD},
+		{"missing method", `{}`, CATEGORY_UNKNOWN_METHOD},
+		{"too large", `{"method":"transmit", "data":"` + strings.Repeat("00", int(MaxRequestSize)) + `"}`, CATEGORY_CLIENT_ERROR},
+	}
+	for _, test := range tests {
+		writer := &bytes.Buffer{}
+		if err := ScardJson(strings.NewReader(test.req), writer); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		resp := ScardResponse{}
+		if err := decodeFully(writer, &resp); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if resp.Error == nil || resp.Error.Category != test.category {
+			t.Errorf("%s: unexpected error: %v", test.name, resp.Error)
+		}
+	}
+
+	resp := ScardVersionResponse{}
+	virtualCall(t, "\n{\"method\":\"version\"}\n", &resp)
+	if resp.Error != nil {
+		t.Errorf("surrounding whitespace rejected: %s", resp.Error)
+	}
+
+	writer := &bytes.Buffer{}
+	if err := ScardJson(failingReader{}, writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeFully(writer, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil || resp.Error.Category != CATEGORY_INTERNAL_ERROR {
+		t.Errorf("read error not reported: %v", resp.Error)
+	}
+}
+
+func TestReaperSparesBlockedCalls(t *testing.T) {
+	ctx, err := getContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseContext(ctx, LEAVE_CARD)
+
+	states := []scard.ReaderState{{Reader: PNP_NOTIFICATION}}
+	if err = contextFor(ctx).GetStatusChange(states, 0); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan ScardGetStatusChangeResponse, 1)
+	go func() {
+		resp := ScardGetStatusChangeResponse{}
+		virtualCall(t, fmt.Sprintf(`{"method":"getStatusChange", "ctx":"%s", "timeout":-1, "readerStates":[{"reader":"%s", "currentState":%d}]}`,
+			ctx, strings.Replace(PNP_NOTIFICATION, `\`, `\\`, -1), states[0].EventState&^scard.STATE_CHANGED), &resp)
+		done <- resp
+	}()
+	for h := contexts.lookup(string(ctx)); atomic.LoadInt32(&h.calls) == 0; {
+		select {
+		case resp := <-done:
+			t.Fatalf("getStatusChange didn't block: %v", resp)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	defer func(c time.Duration) { ContextIdleTimeout = c }(ContextIdleTimeout)
+	ContextIdleTimeout = time.Second
+	reap(time.Now().Add(time.Minute))
+	if !contexts.has(string(ctx)) {
+		t.Error("context reaped during getStatusChange")
+	}
+
+	virtualCall(t, fmt.Sprintf(`{"method":"cancel", "ctx":"%s"}`, ctx), &ScardResponse{})
+	if resp := <-done; !resp.Error.HasCode(scard.E_CANCELLED) {
+		t.Errorf("unexpected error: %v", resp.Error)
+	}
 }
@@ -0,0 +1,205 @@
+package json
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// A Session groups the contexts established by one client, e.g. an HTTP
+// session. Requests run through a session can only use contexts (and
+// hence cards) established through the same session, other tokens are
+// reported as unknown. Close releases all contexts of the session.
+//
+// The package level ScardJson doesn't restrict which tokens are used.
+type Session struct {
+	// the backend contexts are established with, nil for the default.
+	backend  Backend
+	lock     sync.Mutex
+	contexts map[Context]bool
+	closed   bool
+	// the context used by Call for requests not naming one.
+	context Context
+}
+
+func NewSession() *Session {
+	return NewSessionWithBackend(nil)
+}
+
+// NewSessionWithBackend returns a session establishing its contexts with
+// b, nil uses the default backend (see SetBackend).
+func NewSessionWithBackend(b Backend) *Session {
+	return &Session{backend: b, contexts: make(map[Context]bool)}
+}
+
+// Backend returns the backend the session's contexts are established
+// with, outside of sessions (s is nil) that's the default backend.
+func (s *Session) Backend() Backend {
+	if s == nil || s.backend == nil {
+		return DefaultBackend()
+	}
+	return s.backend
+}
+
+// ScardJson is ScardJson restricted to the session's tokens.
+func (s *Session) ScardJson(r io.Reader, w io.Writer) (err error) {
+	return writeResponse(scardJsonResponse(s, r), w)
+}
+
+// ScardJsonResponse is ScardJsonResponse restricted to the session's
+// tokens.
+func (s *Session) ScardJsonResponse(r io.Reader) interface{} {
+	return scardJsonResponse(s, r)
+}
+
+// Call runs the method name in the session, for transports not using the
+// JSON envelope (e.g. the REST URLs of emv/http). The request's fields are
+// read from r, if not nil, and set from fields, which take precedence.
+// Requests of methods taking a context but not naming one are run with
+// the context of their "card", or else with the session's default
+// context, see Context.
+func (s *Session) Call(name string, r io.Reader, fields map[string]interface{}) interface{} {
+	resp, err := s.call(name, r, fields)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return resp
+}
+
+func (s *Session) call(name string, r io.Reader, fields map[string]interface{}) (resp interface{}, err error) {
+	m := lookupMethod(name)
+	if m == nil {
+		return nil, errUnknownMethod(name)
+	}
+
+	params := make(map[string]json.RawMessage)
+	if r != nil {
+		var req json.RawMessage
+		if req, err = readRequest(r); err != nil {
+			return
+		} else if err = json.Unmarshal(req, &params); err != nil {
+			return nil, errParse(err)
+		} else if params == nil {
+			params = make(map[string]json.RawMessage)
+		}
+	}
+	for field, value := range fields {
+		if params[field], err = json.Marshal(value); err != nil {
+			return
+		}
+	}
+
+	if _, ok := m.request.FieldByName("Ctx"); ok && params["ctx"] == nil {
+		var ctx Context
+		var card Card
+		// a malformed card is reported when decoding the request.
+		if json.Unmarshal(params["card"], &card) == nil && card != "" {
+			ctx, err = s.cardContext(card)
+		} else {
+			ctx, err = s.Context()
+		}
+		if err != nil {
+			return
+		}
+		params["ctx"], _ = json.Marshal(ctx)
+	}
+
+	req, _ := json.Marshal(params)
+	return m.call(s, req)
+}
+
+// Context returns the session's default context, it's established on
+// first use and whenever the previous one was released.
+func (s *Session) Context() (ctx Context, err error) {
+	s.lock.Lock()
+	ctx = s.context
+	s.lock.Unlock()
+	if ctx != "" && contexts.has(string(ctx)) {
+		return
+	}
+
+	resp, err := callMethod(s, "establishContext", json.RawMessage("{}"))
+	if err != nil {
+		return "", err
+	}
+	ctx = resp.(*ScardContextResponse).Ctx
+	s.lock.Lock()
+	s.context = ctx
+	s.lock.Unlock()
+	return
+}
+
+// cardContext returns the context card was connected with, the card is
+// unknown unless that's one of the session's contexts.
+func (s *Session) cardContext(card Card) (Context, error) {
+	h := cards.lookup(string(card))
+	if h == nil {
+		return "", unknownCard(card)
+	} else if !s.owns(h.parent) {
+		return "", errUnknownCard
+	}
+	return h.parent, nil
+}
+
+// owns reports whether ctx may be used through the session, a nil
+// session allows all contexts.
+func (s *Session) owns(ctx Context) bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.contexts[ctx]
+}
+
+// add records a context established through the session. Contexts
+// established while the session is being closed are released right away.
+func (s *Session) add(ctx Context) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	closed := s.closed
+	if !closed {
+		// forget the contexts released by the client or the reaper.
+		for tok := range s.contexts {
+			if !contexts.has(string(tok)) {
+				delete(s.contexts, tok)
+			}
+		}
+		s.contexts[ctx] = true
+	}
+	s.lock.Unlock()
+
+	if closed {
+		releaseContext(ctx, ReleaseDisposition)
+	}
+}
+
+// Contexts returns the contexts currently established through the
+// session.
+func (s *Session) Contexts() []Context {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tokens := make([]Context, 0, len(s.contexts))
+	for tok := range s.contexts {
+		if contexts.has(string(tok)) {
+			tokens = append(tokens, tok)
+		}
+	}
+	return tokens
+}
+
+// Close releases the session's contexts, disconnecting their cards with
+// ReleaseDisposition.
+func (s *Session) Close() {
+	s.lock.Lock()
+	s.closed = true
+	tokens := s.contexts
+	s.contexts = make(map[Context]bool)
+	s.lock.Unlock()
+
+	for tok := range tokens {
+		releaseContext(tok, ReleaseDisposition)
+	}
+}
@@ -0,0 +1,125 @@
+package json
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+import "github.com/ebfe/go.pcsclite/scard"
+
+func sessionCall(t *testing.T, s *Session, req string, resp interface{}) {
+	writer := &bytes.Buffer{}
+	if err := s.ScardJson(strings.NewReader(req), writer); err != nil {
+		t.Fatal(err)
+	} else if err = decodeFully(writer, resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	s, other := NewSession(), NewSession()
+	defer other.Close()
+
+	ctx := ScardContextResponse{}
+	sessionCall(t, s, `{"method":"establishContext"}`, &ctx)
+	if ctx.Error != nil {
+		t.Fatal(ctx.Error)
+	}
+	batch := ScardBatchResponse{}
+	sessionCall(t, s, `{"method":"batch", "requests":[{"method":"establishContext"}]}`, &batch)
+	if batch.Error != nil {
+		t.Fatal(batch.Error)
+	}
+	if n := len(s.Contexts()); n != 2 {
+		t.Errorf("expected 2 contexts in session, got %d", n)
+	}
+
+	isValid := fmt.Sprintf(`{"method":"isValid", "ctx":"%s"}`, ctx.Ctx)
+	resp := ScardResponse{}
+	sessionCall(t, s, isValid, &resp)
+	if resp.Error != nil {
+		t.Errorf("context unusable in its session: %v", resp.Error)
+	}
+	resp = ScardResponse{}
+	sessionCall(t, other, isValid, &resp)
+	if !resp.Error.HasCode(scard.E_INVALID_HANDLE) {
+		t.Errorf("context usable in other session: %v", resp.Error)
+	}
+	resp = ScardResponse{}
+	sessionCall(t, other, fmt.Sprintf(`[{"method":"isValid", "ctx":"%s"}]`, ctx.Ctx), &[]interface{}{&resp})
+	if !resp.Error.HasCode(scard.E_INVALID_HANDLE) {
+		t.Errorf("context usable in other session's batch: %v", resp.Error)
+	}
+
+	s.Close()
+	if n := len(s.Contexts()); n != 0 {
+		t.Errorf("%d contexts left after Close", n)
+	}
+	resp = ScardResponse{}
+	virtualCall(t, isValid, &resp)
+	if resp.Error == nil {
+		t.Error("context still valid after Close")
+	}
+}
+
+func TestSessionCall(t *testing.T) {
+	s := NewSession()
+	defer s.Close()
+
+	readers, ok := s.Call("listReaders", nil, nil).(*ScardListReadersResponse)
+	if !ok || len(s.Contexts()) != 1 {
+		t.Fatalf("listReaders didn't use default context: %v", readers)
+	}
+	ctx, err := s.Context()
+	if err != nil || ctx != s.Contexts()[0] {
+		t.Fatalf("unexpected default context %s: %v", ctx, err)
+	}
+
+	resp, ok := s.Call("connect", nil, map[string]interface{}{
+		"reader": readers.Readers[0], "shareMode": SHARE_DIRECT, "protocol": PROTOCOL_UNDEFINED,
+	}).(*ScardConnectResponse)
+	if !ok {
+		t.Fatal("connect failed")
+	}
+	status, ok := s.Call("status", nil, map[string]interface{}{"card": resp.Card}).(*ScardStatusResponse)
+	if !ok || status.Reader != readers.Readers[0] {
+		t.Errorf("status didn't use the card's context: %v", status)
+	}
+
+	other := NewSession()
+	defer other.Close()
+	if e := ResponseError(other.Call("status", nil, map[string]interface{}{"card": resp.Card})); !e.HasCode(scard.E_INVALID_HANDLE) {
+		t.Errorf("card usable in other session: %v", e)
+	}
+
+	for _, body := range []string{``, `[]`, `{"card":1}`, `{"unknown":1}`} {
+		if e := ResponseError(s.Call("status", strings.NewReader(body), nil)); e == nil || e.Category != CATEGORY_PARSE_ERROR {
+			t.Errorf("%s: expected parse error, got %v", body, e)
+		}
+	}
+	if e := ResponseError(s.Call("nonsense", nil, nil)); e == nil || e.Category != CATEGORY_UNKNOWN_METHOD {
+		t.Errorf("unexpected error for unknown method: %v", e)
+	}
+}
+
+func TestSessionBackend(t *testing.T) {
+	s := NewSessionWithBackend(versionBackend("session"))
+	defer s.Close()
+
+	resp := ScardVersionResponse{}
+	sessionCall(t, s, `{"method":"version"}`, &resp)
+	if resp.Version != "session" {
+		t.Errorf("session backend not used, version: %s", resp.Version)
+	}
+	ctx := ScardContextResponse{}
+	sessionCall(t, s, `{"method":"establishContext"}`, &ctx)
+	if !ctx.Error.HasCode(scard.E_NO_SERVICE) {
+		t.Errorf("unexpected error: %v", ctx.Error)
+	}
+
+	if NewSession().Backend() != DefaultBackend() {
+		t.Error("session without backend doesn't use the default")
+	}
+}
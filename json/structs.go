@@ -1,11 +1,15 @@
 package json
 
+import (
+	"encoding/json"
+)
+
 type ScardRequest struct {
 	Method string `json:"method"`
 }
 
 type ScardResponse struct {
-	Error string `json:"error"`
+	Error *ScardError `json:"error,omitempty"`
 }
 
 type ScardVersionResponse struct {
@@ -23,11 +27,28 @@ type ScardCtxRequest struct {
 	Ctx Context `json:"ctx"`
 }
 
+type ScardReleaseContextRequest struct {
+	ScardRequest
+	Ctx         Context     `json:"ctx"`
+	Disposition Disposition `json:"disposition,omitempty"`
+}
+
+type ScardListReadersRequest struct {
+	ScardRequest
+	Ctx    Context  `json:"ctx"`
+	Groups []string `json:"groups,omitempty"`
+}
+
 type ScardListReadersResponse struct {
 	ScardResponse
 	Readers []string `json:"readers"`
 }
 
+type ScardListReaderGroupsResponse struct {
+	ScardResponse
+	Groups []string `json:"groups"`
+}
+
 type ScardConnectRequest struct {
 	ScardRequest
 	Ctx       Context   `json:"ctx"`
@@ -43,7 +64,8 @@ type ScardConnectResponse struct {
 
 type ScardStatusRequest struct {
 	ScardRequest
-	Card Card `json:"card"`
+	Ctx  Context `json:"ctx"`
+	Card Card    `json:"card"`
 }
 
 type ScardStatusResponse struct {
@@ -57,18 +79,127 @@ type ScardStatusResponse struct {
 
 type ScardDisconnectRequest struct {
 	ScardRequest
+	Ctx         Context     `json:"ctx"`
 	Card        Card        `json:"card"`
 	Disposition Disposition `json:"disposition"`
 }
 
 type ScardTransmitRequest struct {
 	ScardRequest
+	Ctx  Context `json:"ctx"`
+	Card Card    `json:"card"`
+	Data string  `json:"data"`
+}
+
+type ScardTransmitResponse struct {
+	ScardResponse
 	Card Card   `json:"card"`
 	Data string `json:"data"`
 }
 
-type ScardTransmitResponse struct {
+type ReaderState struct {
+	Reader       string `json:"reader"`
+	CurrentState uint32 `json:"currentState"`
+	EventState   uint32 `json:"eventState"`
+	ATR          string `json:"atr"`
+}
+
+// Timeout is in milliseconds, a negative timeout blocks until a change
+// occurs.
+type ScardGetStatusChangeRequest struct {
+	ScardRequest
+	Ctx          Context       `json:"ctx"`
+	Timeout      int64         `json:"timeout"`
+	ReaderStates []ReaderState `json:"readerStates"`
+}
+
+type ScardGetStatusChangeResponse struct {
+	ScardResponse
+	ReaderStates []ReaderState `json:"readerStates"`
+}
+
+type ScardReconnectRequest struct {
+	ScardRequest
+	Ctx         Context     `json:"ctx"`
+	Card        Card        `json:"card"`
+	ShareMode   ShareMode   `json:"shareMode"`
+	Protocol    Protocol    `json:"protocol"`
+	Disposition Disposition `json:"disposition"`
+}
+
+type ScardReconnectResponse struct {
+	ScardResponse
+	Card           Card     `json:"card"`
+	ActiveProtocol Protocol `json:"activeProtocol"`
+}
+
+type ScardBeginTransactionRequest struct {
+	ScardRequest
+	Ctx         Context     `json:"ctx"`
+	Card        Card        `json:"card"`
+	Disposition Disposition `json:"disposition"`
+}
+
+type ScardEndTransactionRequest struct {
+	ScardRequest
+	Ctx         Context     `json:"ctx"`
+	Card        Card        `json:"card"`
+	Disposition Disposition `json:"disposition"`
+}
+
+type ScardControlRequest struct {
+	ScardRequest
+	Ctx         Context `json:"ctx"`
+	Card        Card    `json:"card"`
+	ControlCode uint32  `json:"controlCode"`
+	Data        string  `json:"data"`
+}
+
+type ScardControlResponse struct {
 	ScardResponse
 	Card Card   `json:"card"`
 	Data string `json:"data"`
 }
+
+// AttrId is either the numeric dwAttrId or a SCARD_ATTR_* name.
+type ScardGetAttribRequest struct {
+	ScardRequest
+	Ctx    Context `json:"ctx"`
+	Card   Card    `json:"card"`
+	AttrId Attrib  `json:"attrId"`
+}
+
+type ScardGetAttribResponse struct {
+	ScardResponse
+	Card   Card        `json:"card"`
+	AttrId Attrib      `json:"attrId"`
+	Data   string      `json:"data"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+type ScardSetAttribRequest struct {
+	ScardRequest
+	Ctx    Context `json:"ctx"`
+	Card   Card    `json:"card"`
+	AttrId Attrib  `json:"attrId"`
+	Data   string  `json:"data"`
+}
+
+// Requests are run in order, optionally inside a transaction on Card
+// which is ended with Disposition (default LEAVE_CARD).
+type ScardBatchRequest struct {
+	ScardRequest
+	Requests    []json.RawMessage `json:"requests"`
+	StopOnError bool              `json:"stopOnError,omitempty"`
+	Transaction bool              `json:"transaction,omitempty"`
+	Ctx         Context           `json:"ctx,omitempty"`
+	Card        Card              `json:"card,omitempty"`
+	Disposition Disposition       `json:"disposition,omitempty"`
+}
+
+type ScardBatchResponse struct {
+	ScardResponse
+	Responses []interface{} `json:"responses"`
+	// set if the transaction couldn't be ended, e.g. the card was removed.
+	TransactionError *ScardError `json:"transactionError,omitempty"`
+}
@@ -1,5 +1,12 @@
 package json
 
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
 import "github.com/ebfe/go.pcsclite/scard"
 
 type Context string
@@ -61,6 +68,17 @@ const (
 	SHARE_DIRECT    ShareMode = "DIRECT"
 )
 
+func ShareModeFromScard(s scard.ShareMode) ShareMode {
+	switch s {
+	case scard.SHARE_EXCLUSIVE:
+		return SHARE_EXCLUSIVE
+	case scard.SHARE_DIRECT:
+		return SHARE_DIRECT
+	default:
+		return SHARE_SHARED
+	}
+}
+
 func (s *ShareMode) Scard() scard.ShareMode {
 	switch *s {
 	case SHARE_EXCLUSIVE:
@@ -87,6 +105,19 @@ const (
 	EJECT_CARD   Disposition = "EJECT_CARD"
 )
 
+func DispositionFromScard(d scard.Disposition) Disposition {
+	switch d {
+	case scard.RESET_CARD:
+		return RESET_CARD
+	case scard.UNPOWER_CARD:
+		return UNPOWER_CARD
+	case scard.EJECT_CARD:
+		return EJECT_CARD
+	default:
+		return LEAVE_CARD
+	}
+}
+
 func (d *Disposition) Scard() scard.Disposition {
 	switch *d {
 	case LEAVE_CARD:
@@ -105,3 +136,200 @@ func (d *Disposition) Scard() scard.Disposition {
 func (d *Disposition) OK() bool {
 	return *d == LEAVE_CARD || *d == RESET_CARD || *d == UNPOWER_CARD || *d == EJECT_CARD
 }
+
+// Attrib identifies a reader attribute. In JSON it may be given either as
+// the numeric dwAttrId or as one of the symbolic SCARD_ATTR_* names.
+type Attrib uint32
+
+const (
+	ATTR_VENDOR_NAME              Attrib = 0x00010100
+	ATTR_VENDOR_IFD_TYPE          Attrib = 0x00010101
+	ATTR_VENDOR_IFD_VERSION       Attrib = 0x00010102
+	ATTR_VENDOR_IFD_SERIAL_NO     Attrib = 0x00010103
+	ATTR_CHANNEL_ID               Attrib = 0x00020110
+	ATTR_ASYNC_PROTOCOL_TYPES     Attrib = 0x00030120
+	ATTR_DEFAULT_CLK              Attrib = 0x00030121
+	ATTR_MAX_CLK                  Attrib = 0x00030122
+	ATTR_DEFAULT_DATA_RATE        Attrib = 0x00030123
+	ATTR_MAX_DATA_RATE            Attrib = 0x00030124
+	ATTR_MAX_IFSD                 Attrib = 0x00030125
+	ATTR_SYNC_PROTOCOL_TYPES      Attrib = 0x00030126
+	ATTR_POWER_MGMT_SUPPORT       Attrib = 0x00040131
+	ATTR_USER_TO_CARD_AUTH_DEVICE Attrib = 0x00050140
+	ATTR_USER_AUTH_INPUT_DEVICE   Attrib = 0x00050142
+	ATTR_CHARACTERISTICS          Attrib = 0x00060150
+	ATTR_ESC_RESET                Attrib = 0x0007A000
+	ATTR_ESC_CANCEL               Attrib = 0x0007A003
+	ATTR_ESC_AUTHREQUEST          Attrib = 0x0007A005
+	ATTR_MAXINPUT                 Attrib = 0x0007A007
+	ATTR_CURRENT_PROTOCOL_TYPE    Attrib = 0x00080201
+	ATTR_CURRENT_CLK              Attrib = 0x00080202
+	ATTR_CURRENT_F                Attrib = 0x00080203
+	ATTR_CURRENT_D                Attrib = 0x00080204
+	ATTR_CURRENT_N                Attrib = 0x00080205
+	ATTR_CURRENT_W                Attrib = 0x00080206
+	ATTR_CURRENT_IFSC             Attrib = 0x00080207
+	ATTR_CURRENT_IFSD             Attrib = 0x00080208
+	ATTR_CURRENT_BWT              Attrib = 0x00080209
+	ATTR_CURRENT_CWT              Attrib = 0x0008020A
+	ATTR_CURRENT_EBC_ENCODING     Attrib = 0x0008020B
+	ATTR_EXTENDED_BWT             Attrib = 0x0008020C
+	ATTR_ICC_PRESENCE             Attrib = 0x00090300
+	ATTR_ICC_INTERFACE_STATUS     Attrib = 0x00090301
+	ATTR_CURRENT_IO_STATE         Attrib = 0x00090302
+	ATTR_ATR_STRING               Attrib = 0x00090303
+	ATTR_ICC_TYPE_PER_ATR         Attrib = 0x00090304
+	ATTR_DEVICE_UNIT              Attrib = 0x7FFF0001
+	ATTR_DEVICE_IN_USE            Attrib = 0x7FFF0002
+	ATTR_DEVICE_FRIENDLY_NAME     Attrib = 0x7FFF0003
+	ATTR_DEVICE_SYSTEM_NAME       Attrib = 0x7FFF0004
+	ATTR_SUPRESS_T1_IFS_REQUEST   Attrib = 0x7FFF0007
+)
+
+var attribNames = map[Attrib]string{
+	ATTR_VENDOR_NAME:              "SCARD_ATTR_VENDOR_NAME",
+	ATTR_VENDOR_IFD_TYPE:          "SCARD_ATTR_VENDOR_IFD_TYPE",
+	ATTR_VENDOR_IFD_VERSION:       "SCARD_ATTR_VENDOR_IFD_VERSION",
+	ATTR_VENDOR_IFD_SERIAL_NO:     "SCARD_ATTR_VENDOR_IFD_SERIAL_NO",
+	ATTR_CHANNEL_ID:               "SCARD_ATTR_CHANNEL_ID",
+	ATTR_ASYNC_PROTOCOL_TYPES:     "SCARD_ATTR_ASYNC_PROTOCOL_TYPES",
+	ATTR_DEFAULT_CLK:              "SCARD_ATTR_DEFAULT_CLK",
+	ATTR_MAX_CLK:                  "SCARD_ATTR_MAX_CLK",
+	ATTR_DEFAULT_DATA_RATE:        "SCARD_ATTR_DEFAULT_DATA_RATE",
+	ATTR_MAX_DATA_RATE:            "SCARD_ATTR_MAX_DATA_RATE",
+	ATTR_MAX_IFSD:                 "SCARD_ATTR_MAX_IFSD",
+	ATTR_SYNC_PROTOCOL_TYPES:      "SCARD_ATTR_SYNC_PROTOCOL_TYPES",
+	ATTR_POWER_MGMT_SUPPORT:       "SCARD_ATTR_POWER_MGMT_SUPPORT",
+	ATTR_USER_TO_CARD_AUTH_DEVICE: "SCARD_ATTR_USER_TO_CARD_AUTH_DEVICE",
+	ATTR_USER_AUTH_INPUT_DEVICE:   "SCARD_ATTR_USER_AUTH_INPUT_DEVICE",
+	ATTR_CHARACTERISTICS:          "SCARD_ATTR_CHARACTERISTICS",
+	ATTR_ESC_RESET:                "SCARD_ATTR_ESC_RESET",
+	ATTR_ESC_CANCEL:               "SCARD_ATTR_ESC_CANCEL",
+	ATTR_ESC_AUTHREQUEST:          "SCARD_ATTR_ESC_AUTHREQUEST",
+	ATTR_MAXINPUT:                 "SCARD_ATTR_MAXINPUT",
+	ATTR_CURRENT_PROTOCOL_TYPE:    "SCARD_ATTR_CURRENT_PROTOCOL_TYPE",
+	ATTR_CURRENT_CLK:              "SCARD_ATTR_CURRENT_CLK",
+	ATTR_CURRENT_F:                "SCARD_ATTR_CURRENT_F",
+	ATTR_CURRENT_D:                "SCARD_ATTR_CURRENT_D",
+	ATTR_CURRENT_N:                "SCARD_ATTR_CURRENT_N",
+	ATTR_CURRENT_W:                "SCARD_ATTR_CURRENT_W",
+	ATTR_CURRENT_IFSC:             "SCARD_ATTR_CURRENT_IFSC",
+	ATTR_CURRENT_IFSD:             "SCARD_ATTR_CURRENT_IFSD",
+	ATTR_CURRENT_BWT:              "SCARD_ATTR_CURRENT_BWT",
+	ATTR_CURRENT_CWT:              "SCARD_ATTR_CURRENT_CWT",
+	ATTR_CURRENT_EBC_ENCODING:     "SCARD_ATTR_CURRENT_EBC_ENCODING",
+	ATTR_EXTENDED_BWT:             "SCARD_ATTR_EXTENDED_BWT",
+	ATTR_ICC_PRESENCE:             "SCARD_ATTR_ICC_PRESENCE",
+	ATTR_ICC_INTERFACE_STATUS:     "SCARD_ATTR_ICC_INTERFACE_STATUS",
+	ATTR_CURRENT_IO_STATE:         "SCARD_ATTR_CURRENT_IO_STATE",
+	ATTR_ATR_STRING:               "SCARD_ATTR_ATR_STRING",
+	ATTR_ICC_TYPE_PER_ATR:         "SCARD_ATTR_ICC_TYPE_PER_ATR",
+	ATTR_DEVICE_UNIT:              "SCARD_ATTR_DEVICE_UNIT",
+	ATTR_DEVICE_IN_USE:            "SCARD_ATTR_DEVICE_IN_USE",
+	ATTR_DEVICE_FRIENDLY_NAME:     "SCARD_ATTR_DEVICE_FRIENDLY_NAME",
+	ATTR_DEVICE_SYSTEM_NAME:       "SCARD_ATTR_DEVICE_SYSTEM_NAME",
+	ATTR_SUPRESS_T1_IFS_REQUEST:   "SCARD_ATTR_SUPRESS_T1_IFS_REQUEST",
+}
+
+// attributes containing (NUL terminated) strings
+var stringAttribs = map[Attrib]bool{
+	ATTR_VENDOR_NAME:          true,
+	ATTR_VENDOR_IFD_TYPE:      true,
+	ATTR_VENDOR_IFD_SERIAL_NO: true,
+	ATTR_DEVICE_FRIENDLY_NAME: true,
+	ATTR_DEVICE_SYSTEM_NAME:   true,
+}
+
+// attributes containing a little endian DWORD
+var intAttribs = map[Attrib]bool{
+	ATTR_VENDOR_IFD_VERSION:    true,
+	ATTR_CHANNEL_ID:            true,
+	ATTR_ASYNC_PROTOCOL_TYPES:  true,
+	ATTR_DEFAULT_CLK:           true,
+	ATTR_MAX_CLK:               true,
+	ATTR_DEFAULT_DATA_RATE:     true,
+	ATTR_MAX_DATA_RATE:         true,
+	ATTR_MAX_IFSD:              true,
+	ATTR_SYNC_PROTOCOL_TYPES:   true,
+	ATTR_POWER_MGMT_SUPPORT:    true,
+	ATTR_CHARACTERISTICS:       true,
+	ATTR_CURRENT_PROTOCOL_TYPE: true,
+	ATTR_CURRENT_CLK:           true,
+	ATTR_CURRENT_F:             true,
+	ATTR_CURRENT_D:             true,
+	ATTR_CURRENT_N:             true,
+	ATTR_CURRENT_W:             true,
+	ATTR_CURRENT_IFSC:          true,
+	ATTR_CURRENT_IFSD:          true,
+	ATTR_CURRENT_BWT:           true,
+	ATTR_CURRENT_CWT:           true,
+	ATTR_EXTENDED_BWT:          true,
+	ATTR_ICC_PRESENCE:          true,
+	ATTR_ICC_INTERFACE_STATUS:  true,
+	ATTR_ICC_TYPE_PER_ATR:      true,
+	ATTR_MAXINPUT:              true,
+	ATTR_DEVICE_UNIT:           true,
+	ATTR_DEVICE_IN_USE:         true,
+}
+
+func AttribFromName(name string) (a Attrib, ok bool) {
+	if !strings.HasPrefix(name, "SCARD_") {
+		name = "SCARD_" + name
+	}
+	for a, n := range attribNames {
+		if n == name {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+func (a Attrib) String() string {
+	if name, ok := attribNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08X", uint32(a))
+}
+
+func (a *Attrib) Scard() scard.Attrib {
+	return scard.Attrib(*a)
+}
+
+// Decode returns the attribute value as a string or integer for well
+// known attributes and nil for everything else.
+func (a *Attrib) Decode(data []byte) interface{} {
+	switch {
+	case stringAttribs[*a]:
+		return strings.TrimRight(string(data), "\x00")
+	case intAttribs[*a] && len(data) == 4:
+		return binary.LittleEndian.Uint32(data)
+	case intAttribs[*a] && len(data) == 1:
+		return uint32(data[0])
+	default:
+		return nil
+	}
+}
+
+func (a Attrib) MarshalJSON() ([]byte, error) {
+	if name, ok := attribNames[a]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(uint32(a))
+}
+
+func (a *Attrib) UnmarshalJSON(b []byte) (err error) {
+	var name string
+	if err = json.Unmarshal(b, &name); err == nil {
+		var ok bool
+		if *a, ok = AttribFromName(name); !ok {
+			return fmt.Errorf("unknown attribute: %s", name)
+		}
+		return nil
+	}
+	var id uint32
+	if err = json.Unmarshal(b, &id); err != nil {
+		return err
+	}
+	*a = Attrib(id)
+	return nil
+}